@@ -8,9 +8,10 @@ import (
 const usage = `botlockbox — credential-injecting HTTPS/HTTP MITM proxy
 
 Usage:
-  botlockbox seal   [flags]   seal secrets into an age-encrypted envelope
-  botlockbox serve  [flags]   run the proxy server
-  botlockbox reload [flags]   send SIGHUP to a running serve process to reload secrets
+  botlockbox seal      [flags]   seal secrets into an age-encrypted envelope
+  botlockbox serve     [flags]   run the proxy server
+  botlockbox reload    [flags]   send SIGHUP to a running serve process to reload secrets
+  botlockbox rotate-ca [flags]   send SIGUSR1 to a running serve process to rotate the MITM CA
 
 Run 'botlockbox <subcommand> -h' for subcommand flags.
 `
@@ -28,6 +29,8 @@ func main() {
 		runServe(os.Args[2:])
 	case "reload":
 		runReload(os.Args[2:])
+	case "rotate-ca":
+		runRotateCA(os.Args[2:])
 	default:
 		fmt.Fprintf(os.Stderr, "unknown subcommand %q\n\n", os.Args[1])
 		fmt.Fprint(os.Stderr, usage)
@@ -25,16 +25,41 @@ func runReload(args []string) {
 		os.Exit(1)
 	}
 
-	data, err := os.ReadFile(*pidfilePath)
+	signalPIDFile(*pidfilePath, syscall.SIGHUP, "SIGHUP")
+}
+
+func runRotateCA(args []string) {
+	fs := flag.NewFlagSet("rotate-ca", flag.ExitOnError)
+	pidfilePath := fs.String("pidfile", "", "path to the PID file written by 'botlockbox serve' (required)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: botlockbox rotate-ca [flags]")
+		fmt.Fprintln(os.Stderr, "Sends SIGUSR1 to a running botlockbox serve process to rotate the MITM CA now.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *pidfilePath == "" {
+		fmt.Fprintln(os.Stderr, "error: --pidfile is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	signalPIDFile(*pidfilePath, syscall.SIGUSR1, "SIGUSR1")
+}
+
+// signalPIDFile sends sig to the process whose PID is stored in pidfilePath,
+// exiting on any error.
+func signalPIDFile(pidfilePath string, sig syscall.Signal, sigName string) {
+	data, err := os.ReadFile(pidfilePath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading PID file %q: %v\n", *pidfilePath, err)
+		fmt.Fprintf(os.Stderr, "error reading PID file %q: %v\n", pidfilePath, err)
 		os.Exit(1)
 	}
 
 	pidStr := strings.TrimSpace(string(data))
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "invalid PID in file %q: %q\n", *pidfilePath, pidStr)
+		fmt.Fprintf(os.Stderr, "invalid PID in file %q: %q\n", pidfilePath, pidStr)
 		os.Exit(1)
 	}
 
@@ -44,10 +69,10 @@ func runReload(args []string) {
 		os.Exit(1)
 	}
 
-	if err := proc.Signal(syscall.SIGHUP); err != nil {
-		fmt.Fprintf(os.Stderr, "error sending SIGHUP to PID %d: %v\n", pid, err)
+	if err := proc.Signal(sig); err != nil {
+		fmt.Fprintf(os.Stderr, "error sending %s to PID %d: %v\n", sigName, pid, err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("SIGHUP sent to PID %d\n", pid)
+	fmt.Printf("%s sent to PID %d\n", sigName, pid)
 }
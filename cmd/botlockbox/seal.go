@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,7 +12,9 @@ import (
 	"time"
 
 	"filippo.io/age"
+	"github.com/awnumar/memguard"
 	"github.com/trodemaster/botlockbox/internal/config"
+	"github.com/trodemaster/botlockbox/internal/proxy"
 	"github.com/trodemaster/botlockbox/internal/secrets"
 	"gopkg.in/yaml.v3"
 )
@@ -21,6 +24,11 @@ func runSeal(args []string) {
 	configPath := fs.String("config", "botlockbox.yaml", "path to botlockbox.yaml")
 	identityPath := fs.String("identity", "", "path to age X25519 identity file (derives recipient from key)")
 	recipientStr := fs.String("recipient", "", "age recipient public key string (use for plugin keys such as age-plugin-se, e.g. age1se1q...)")
+	generateCA := fs.Bool("generate-ca", false, "generate a persistent MITM CA and seal its private key into the envelope (optional)")
+	caValidity := fs.Duration("ca-validity", 365*24*time.Hour, "lifetime of the CA created by --generate-ca")
+	caCertFile := fs.String("ca-cert-file", "", "PEM CA certificate to seal as the persistent MITM CA (requires --ca-key-file)")
+	caKeyFile := fs.String("ca-key-file", "", "PEM CA private key to seal as the persistent MITM CA (requires --ca-cert-file)")
+	caCertOut := fs.String("ca-cert-out", "", "path to write the sealed CA's public certificate PEM (optional)")
 	fs.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: botlockbox seal [flags]")
 		fmt.Fprintln(os.Stderr, "Reads secrets from stdin as YAML (key: value pairs) and seals them.")
@@ -34,6 +42,16 @@ func runSeal(args []string) {
 		fs.Usage()
 		os.Exit(1)
 	}
+	if (*caCertFile == "") != (*caKeyFile == "") {
+		fmt.Fprintln(os.Stderr, "error: --ca-cert-file and --ca-key-file must be given together")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *generateCA && *caCertFile != "" {
+		fmt.Fprintln(os.Stderr, "error: --generate-ca and --ca-cert-file are mutually exclusive")
+		fs.Usage()
+		os.Exit(1)
+	}
 
 	cfg, err := config.Load(*configPath)
 	if err != nil {
@@ -47,6 +65,18 @@ func runSeal(args []string) {
 		os.Exit(1)
 	}
 
+	allowedMethods, err := cfg.AllowedMethodsFromRules()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing rules: %v\n", err)
+		os.Exit(1)
+	}
+	// Only method-restricted secrets are committed; absence means any method.
+	for secretName, methods := range allowedMethods {
+		if methods == nil {
+			delete(allowedMethods, secretName)
+		}
+	}
+
 	// Read secrets from stdin as YAML.
 	stdinData, err := io.ReadAll(os.Stdin)
 	if err != nil {
@@ -67,11 +97,40 @@ func runSeal(args []string) {
 		}
 	}
 
+	// Catch a certificate sealed with the wrong key now rather than at the
+	// first upstream handshake.
+	for _, rule := range cfg.Rules {
+		if cc := rule.Inject.ClientCertificate; cc != nil {
+			if _, err := tls.X509KeyPair([]byte(inputSecrets[cc.Cert]), []byte(inputSecrets[cc.Key])); err != nil {
+				fmt.Fprintf(os.Stderr, "error: rule %q: client_certificate %q/%q: %v\n", rule.Name, cc.Cert, cc.Key, err)
+				os.Exit(1)
+			}
+		}
+	}
+
 	envelope := secrets.SealedEnvelope{
-		Version:      1,
-		SealedAt:     time.Now().UTC(),
-		AllowedHosts: allowedHosts,
-		Secrets:      inputSecrets,
+		Version:         1,
+		SealedAt:        time.Now().UTC(),
+		AllowedHosts:    allowedHosts,
+		AllowedMethods:  allowedMethods,
+		Secrets:         inputSecrets,
+		Egress:          cfg.Egress,
+		EgressAllowlist: cfg.EgressAllowlist,
+	}
+
+	if *generateCA || *caCertFile != "" {
+		sealedCA, err := sealCA(&envelope, cfg, *generateCA, *caValidity, *caCertFile, *caKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error preparing CA: %v\n", err)
+			os.Exit(1)
+		}
+		envelope.CA = sealedCA
+		if *caCertOut != "" {
+			if err := os.WriteFile(*caCertOut, []byte(sealedCA.CertPEM), 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "error writing CA cert: %v\n", err)
+				os.Exit(1)
+			}
+		}
 	}
 
 	envelopeJSON, err := json.Marshal(envelope)
@@ -120,9 +179,55 @@ func runSeal(args []string) {
 	}
 
 	fmt.Printf("Secrets sealed to %s\n", cfg.SecretsFile)
+	if envelope.CA != nil {
+		fmt.Println("Persistent MITM CA sealed into the envelope")
+	}
 	fmt.Printf("Config set to read-only (0444): %s\n", *configPath)
 }
 
+// sealCA returns the persistent MITM CA to store in the envelope, either freshly
+// generated (name-constrained to the envelope's hosts when ca_name_constraints
+// is set) or read from certPath/keyPath (which must then already carry name
+// constraints covering those hosts).
+func sealCA(envelope *secrets.SealedEnvelope, cfg *config.Config, generate bool, validity time.Duration, certPath, keyPath string) (*secrets.SealedCA, error) {
+	var permittedHosts []string
+	if cfg.CANameConstraints {
+		permittedHosts = envelope.SealedHosts()
+		if len(permittedHosts) == 0 {
+			return nil, fmt.Errorf("ca_name_constraints is set but the config commits no hosts")
+		}
+	}
+
+	var certPEM, keyPEM []byte
+	if generate {
+		var err error
+		certPEM, keyPEM, err = proxy.GeneratePersistentCA(validity, permittedHosts)
+		if err != nil {
+			return nil, fmt.Errorf("generating CA: %w", err)
+		}
+	} else {
+		var err error
+		if certPEM, err = os.ReadFile(certPath); err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		if keyPEM, err = os.ReadFile(keyPath); err != nil {
+			return nil, fmt.Errorf("reading CA private key: %w", err)
+		}
+		if err := proxy.ValidateCAKeyPair(certPEM, keyPEM); err != nil {
+			memguard.ScrambleBytes(keyPEM)
+			return nil, err
+		}
+		if cfg.CANameConstraints {
+			if err := proxy.CheckCANameConstraints(certPEM, permittedHosts); err != nil {
+				memguard.ScrambleBytes(keyPEM)
+				return nil, err
+			}
+		}
+	}
+	defer memguard.ScrambleBytes(keyPEM)
+	return &secrets.SealedCA{CertPEM: string(certPEM), KeyPEM: string(keyPEM)}, nil
+}
+
 // resolveRecipient returns an age.Recipient from either a public key string
 // (for plugin keys such as age-plugin-se) or an X25519 identity file.
 func resolveRecipient(identityPath, recipientStr string) (age.Recipient, error) {
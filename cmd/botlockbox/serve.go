@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"filippo.io/age"
 	"github.com/awnumar/memguard"
@@ -72,6 +74,16 @@ func unseal(cfg *config.Config, identities []age.Identity, allowedHosts map[stri
 	if err := envelope.Validate(allowedHosts); err != nil {
 		return nil, fmt.Errorf("SECURITY VIOLATION: %w", err)
 	}
+	if err := envelope.ValidateEgress(cfg.Egress, cfg.EgressAllowlist); err != nil {
+		return nil, fmt.Errorf("SECURITY VIOLATION: %w", err)
+	}
+	allowedMethods, err := cfg.AllowedMethodsFromRules()
+	if err != nil {
+		return nil, fmt.Errorf("parsing rules: %w", err)
+	}
+	if err := envelope.ValidateMethods(allowedMethods); err != nil {
+		return nil, fmt.Errorf("SECURITY VIOLATION: %w", err)
+	}
 
 	lockedSecrets := make(map[string]*memguard.Enclave, len(envelope.Secrets))
 	for name, plaintext := range envelope.Secrets {
@@ -80,9 +92,23 @@ func unseal(cfg *config.Config, identities []age.Identity, allowedHosts map[stri
 		memguard.ScrambleBytes(b)
 	}
 
+	var lockedCAKey *memguard.Enclave
+	if envelope.CA != nil {
+		keyPEM := []byte(envelope.CA.KeyPEM)
+		envelope.CA.KeyPEM = ""
+		block, _ := pem.Decode(keyPEM)
+		memguard.ScrambleBytes(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("sealed CA private key is not valid PEM")
+		}
+		lockedCAKey = memguard.NewEnclave(block.Bytes)
+		memguard.ScrambleBytes(block.Bytes)
+	}
+
 	return &secrets.UnsealResult{
 		Envelope:      &envelope,
 		LockedSecrets: lockedSecrets,
+		LockedCAKey:   lockedCAKey,
 	}, nil
 }
 
@@ -112,6 +138,13 @@ func watchSIGHUP(injector *proxy.Injector, cfg *config.Config, identities []age.
 			fmt.Fprintf(os.Stderr, "botlockbox: reload FAILED (keeping current secrets): %v\n", err)
 			continue
 		}
+		if result.LockedCAKey != nil {
+			// The MITM CA is fixed for the life of the process.
+			if buf, openErr := result.LockedCAKey.Open(); openErr == nil {
+				buf.Destroy()
+			}
+			fmt.Println("botlockbox: note: the sealed CA is only loaded at startup; restart serve to pick up a new CA")
+		}
 		if err := injector.SwapSecrets(result, allowedHosts); err != nil {
 			fmt.Fprintf(os.Stderr, "botlockbox: reload REJECTED (keeping current secrets): %v\n", err)
 			for _, enc := range result.LockedSecrets {
@@ -125,13 +158,63 @@ func watchSIGHUP(injector *proxy.Injector, cfg *config.Config, identities []age.
 	}
 }
 
+// writeCABundle atomically replaces path with the CA trust bundle so clients
+// never read a partially written file.
+func writeCABundle(path string, bundle []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bundle, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// watchCARotation rotates the MITM CA before it expires, or immediately on
+// SIGUSR1, and rewrites the CA bundle at caCertPath (if set) whenever the set
+// of trusted CAs changes. A persistent CA from the envelope is never rotated.
+func watchCARotation(ca *proxy.CAManager, caCertPath string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	if !ca.Rotatable() {
+		for range ch {
+			fmt.Fprintln(os.Stderr, "botlockbox: SIGUSR1 ignored: the MITM CA is sealed in the envelope; re-seal with a new CA and restart to rotate it")
+		}
+	}
+	for {
+		timer := time.NewTimer(time.Until(ca.NextChange()))
+		onDemand := false
+		select {
+		case <-timer.C:
+		case <-ch:
+			timer.Stop()
+			fmt.Println("botlockbox: SIGUSR1 received, rotating MITM CA...")
+			onDemand = true
+		}
+
+		if onDemand || !time.Now().Before(ca.RotateAt()) {
+			if err := ca.Rotate(); err != nil {
+				fmt.Fprintf(os.Stderr, "botlockbox: CA rotation FAILED (keeping current CA): %v\n", err)
+				// Back off so a persistent failure does not spin.
+				time.Sleep(time.Minute)
+				continue
+			}
+			fmt.Println("botlockbox: MITM CA rotated")
+		}
+
+		if caCertPath != "" {
+			if err := writeCABundle(caCertPath, ca.BundlePEM()); err != nil {
+				fmt.Fprintf(os.Stderr, "botlockbox: error writing CA cert: %v\n", err)
+			}
+		}
+	}
+}
+
 func runServe(args []string) {
 	fs := flag.NewFlagSet("serve", flag.ExitOnError)
 	configPath := fs.String("config", "botlockbox.yaml", "path to botlockbox.yaml")
 	identityPath := fs.String("identity", "", "path to age identity file (mutually exclusive with --identity-stdin)")
 	identityStdin := fs.Bool("identity-stdin", false, "read age identity from stdin; key is never written to disk (mutually exclusive with --identity)")
 	pidfilePath := fs.String("pidfile", "", "path to write PID file (optional; used with 'botlockbox reload')")
-	caCertPath := fs.String("ca-cert", "", "path to write the ephemeral MITM CA public certificate PEM (optional; trust this cert in clients)")
+	caCertPath := fs.String("ca-cert", "", "path to write the ephemeral MITM CA public certificate PEM bundle (optional; trust this file in clients; rewritten on CA rotation)")
 	fs.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: botlockbox serve [flags]")
 		fmt.Fprintln(os.Stderr, "Decrypts secrets and starts the MITM proxy.")
@@ -180,7 +263,7 @@ func runServe(args []string) {
 	}
 
 	if *caCertPath != "" {
-		if err := os.WriteFile(*caCertPath, injector.CACertPEM, 0644); err != nil {
+		if err := writeCABundle(*caCertPath, injector.CA.BundlePEM()); err != nil {
 			fmt.Fprintf(os.Stderr, "error writing CA cert: %v\n", err)
 			os.Exit(1)
 		}
@@ -195,8 +278,13 @@ func runServe(args []string) {
 	}
 
 	go watchSIGHUP(injector, cfg, identities, allowedHosts)
+	go watchCARotation(injector.CA, *caCertPath)
 
 	fmt.Println("Host binding verified")
+	fmt.Println("Rule evaluation order:")
+	for _, line := range injector.RuleOrder() {
+		fmt.Printf("  %s\n", line)
+	}
 	fmt.Printf("botlockbox listening on %s\n", cfg.Listen)
 
 	if err := http.ListenAndServe(cfg.Listen, handler); err != nil {
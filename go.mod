@@ -4,8 +4,10 @@ go 1.25.0
 
 require (
 	filippo.io/age v1.3.1
+	github.com/andybalholm/brotli v1.2.0
 	github.com/awnumar/memguard v0.23.0
 	github.com/elazarl/goproxy v1.8.2
+	github.com/klauspost/compress v1.18.0
 	golang.org/x/sys v0.38.0
 	gopkg.in/yaml.v3 v3.0.1
 )
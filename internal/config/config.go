@@ -2,7 +2,9 @@ package config
 
 import (
 	"fmt"
-	"regexp"
+	"slices"
+
+	"github.com/trodemaster/botlockbox/internal/tmpl"
 )
 
 // Config is the structure of botlockbox.yaml.
@@ -12,14 +14,76 @@ type Config struct {
 	Listen      string `yaml:"listen"`
 	SecretsFile string `yaml:"secrets_file"`
 	Verbose     bool   `yaml:"verbose"`
-	Rules       []Rule `yaml:"rules"`
+	// Egress controls what happens to requests whose host matches no rule:
+	// EgressAllow (the default) passes them through untouched, EgressDeny
+	// answers them with a 403 unless the host is in EgressAllowlist.
+	Egress string `yaml:"egress,omitempty"`
+	// EgressAllowlist is a list of host patterns (exact or glob) that may be
+	// reached without a matching rule when Egress is EgressDeny.
+	// It is committed to the sealed envelope at seal time.
+	EgressAllowlist []string `yaml:"egress_allowlist,omitempty"`
+	// MITMHosts forces TLS interception for matching CONNECT hosts even when
+	// no rule targets them (e.g. to apply egress policy or response scrubbing).
+	// The exfiltration guard only sees the hostname of a tunneled host, so
+	// hosts whose traffic it should check must be intercepted.
+	MITMHosts []string `yaml:"mitm_hosts,omitempty"`
+	// PassthroughHosts forces a plain TCP tunnel for matching CONNECT hosts,
+	// even when a rule targets them. Takes precedence over MITMHosts.
+	PassthroughHosts []string `yaml:"passthrough_hosts,omitempty"`
+	// CANameConstraints bakes X.509 name constraints built from the sealed
+	// envelope's hosts into the MITM CA, so it cannot vouch for other sites.
+	CANameConstraints bool `yaml:"ca_name_constraints,omitempty"`
+	// LeafCache tunes the cache of signed MITM leaf certificates.
+	LeafCache LeafCache `yaml:"leaf_cache,omitempty"`
+	// UnknownEncoding decides what happens to a scrubbable response whose
+	// Content-Encoding botlockbox cannot decode: UnknownEncodingStrip (the
+	// default) never forwards the agent's Accept-Encoding and blocks anything
+	// still encoded, UnknownEncodingBlock forwards it but blocks, and
+	// UnknownEncodingPass forwards such responses unscrubbed.
+	UnknownEncoding string `yaml:"unknown_encoding,omitempty"`
+	// Scrub adds named patterns redacted from every response, on top of the
+	// built-in credential patterns and the loaded secret values.
+	Scrub []ScrubPattern `yaml:"scrub,omitempty"`
+	Rules []Rule         `yaml:"rules"`
+}
+
+// LeafCache configures the MITM leaf certificate cache.
+type LeafCache struct {
+	// Size is the maximum number of cached leaf certificates (default 1024).
+	Size int `yaml:"size,omitempty"`
+	// Prewarm signs leaf certificates for every exact (non-glob) rule host at
+	// startup and after each CA rotation.
+	Prewarm bool `yaml:"prewarm,omitempty"`
 }
 
+// Egress modes accepted by Config.Egress.
+const (
+	EgressAllow = "allow"
+	EgressDeny  = "deny"
+)
+
+// Unknown Content-Encoding policies accepted by Config.UnknownEncoding.
+const (
+	UnknownEncodingStrip = "strip"
+	UnknownEncodingBlock = "block"
+	UnknownEncodingPass  = "pass"
+)
+
 // Rule binds a set of match conditions to a credential injection action.
 type Rule struct {
 	Name   string `yaml:"name"`
 	Match  Match  `yaml:"match"`
 	Inject Inject `yaml:"inject"`
+	// Priority orders overlapping rules: higher values are tried first. Ties
+	// go to the more specific match (exact host, then longer path prefix),
+	// then to config order.
+	Priority int `yaml:"priority,omitempty"`
+	// Continue lets later matching rules also apply to a request this rule
+	// matched, so several rules can contribute credentials.
+	Continue bool `yaml:"continue,omitempty"`
+	// Scrub adds named patterns redacted from responses to requests this
+	// rule matched.
+	Scrub []ScrubPattern `yaml:"scrub,omitempty"`
 }
 
 // Match describes which requests the rule applies to.
@@ -28,6 +92,16 @@ type Match struct {
 	Hosts []string `yaml:"hosts"`
 	// PathPrefixes optionally restricts the rule to specific URL path prefixes.
 	PathPrefixes []string `yaml:"path_prefixes,omitempty"`
+	// Methods optionally restricts the rule to these HTTP methods (e.g. GET, HEAD).
+	// The methods each secret may be injected on are committed at seal time.
+	Methods []string `yaml:"methods,omitempty"`
+	// Headers maps a request header name to a predicate one of its values must satisfy.
+	Headers map[string]*Predicate `yaml:"headers,omitempty"`
+	// Query maps a query parameter name to a predicate one of its values must satisfy.
+	Query map[string]*Predicate `yaml:"query,omitempty"`
+	// JSONBody maps a dotted path into a JSON request body (e.g. "model" or
+	// "$.messages.0.role") to a predicate its scalar value must satisfy.
+	JSONBody map[string]*Predicate `yaml:"json_body,omitempty"`
 }
 
 // Inject describes what credentials to add to matching requests.
@@ -36,10 +110,40 @@ type Inject struct {
 	Headers map[string]string `yaml:"headers,omitempty"`
 	// QueryParams maps query parameter name → template string.
 	QueryParams map[string]string `yaml:"query_params,omitempty"`
+	// Cookies maps cookie name → template string. Injected cookies are merged
+	// into the agent's Cookie header, replacing agent cookies of the same name.
+	Cookies map[string]string `yaml:"cookies,omitempty"`
+	// CaptureSetCookies keeps upstream Set-Cookie updates to the injected
+	// cookies in memory, in place of the sealed values, and removes them from
+	// the response the agent sees.
+	CaptureSetCookies bool `yaml:"capture_set_cookies,omitempty"`
+	// Body sets fields of a JSON or form request body from templates.
+	Body *BodyInject `yaml:"body,omitempty"`
+	// StripHeaders lists extra agent-supplied headers to remove before
+	// injecting, on top of the default credential headers.
+	StripHeaders []string `yaml:"strip_headers,omitempty"`
+	// AWSSigV4 re-signs matching requests with AWS Signature Version 4.
+	AWSSigV4 *AWSSigV4 `yaml:"aws_sigv4,omitempty"`
+	// OAuth2ClientCredentials injects a bearer token minted with the OAuth 2.0
+	// client credentials grant.
+	OAuth2ClientCredentials *OAuth2ClientCredentials `yaml:"oauth2_client_credentials,omitempty"`
+	// GitHubApp injects a GitHub App installation token minted with a
+	// sealed app private key.
+	GitHubApp *GitHubApp `yaml:"github_app,omitempty"`
+	// GoogleServiceAccount injects an access token minted with the JWT
+	// bearer flow from a sealed service-account key.
+	GoogleServiceAccount *GoogleServiceAccount `yaml:"google_service_account,omitempty"`
+	// HMAC signs matching requests with an HMAC over configurable parts of
+	// the request, using a sealed key.
+	HMAC *HMAC `yaml:"hmac,omitempty"`
+	// ClientCertificate presents a sealed TLS client certificate when
+	// connecting to the rule's hosts.
+	ClientCertificate *ClientCertificate `yaml:"client_certificate,omitempty"`
 }
 
 // AllowedHostsFromRules derives the map[secretName][]hostGlob from the config's
 // rules by walking every inject directive and extracting referenced secret names.
+// A secret a rule sends to a token endpoint is also bound to that endpoint's host.
 //
 // This map is used at seal time to commit the binding, and at serve time to
 // validate the live config against the sealed envelope.
@@ -47,7 +151,7 @@ func (c *Config) AllowedHostsFromRules() (map[string][]string, error) {
 	result := make(map[string][]string)
 
 	for _, rule := range c.Rules {
-		secretNames, err := extractSecretNames(rule.Inject)
+		secretNames, err := rule.Inject.SecretNames()
 		if err != nil {
 			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
 		}
@@ -57,7 +161,8 @@ func (c *Config) AllowedHostsFromRules() (map[string][]string, error) {
 			for _, h := range existing {
 				hostSet[h] = struct{}{}
 			}
-			for _, h := range rule.Match.Hosts {
+			hosts := append(slices.Clone(rule.Match.Hosts), rule.Inject.endpointHosts()[secretName]...)
+			for _, h := range hosts {
 				if _, seen := hostSet[h]; !seen {
 					existing = append(existing, h)
 					hostSet[h] = struct{}{}
@@ -69,30 +174,136 @@ func (c *Config) AllowedHostsFromRules() (map[string][]string, error) {
 	return result, nil
 }
 
-// secretsTemplateRe matches {{secrets.key_name}} patterns.
-var secretsTemplateRe = regexp.MustCompile(`\{\{secrets\.([a-zA-Z0-9_]+)\}\}`)
+// AllowedMethodsFromRules derives the map[secretName][]method binding from the
+// config's rules. A secret maps to the sorted union of the methods of every
+// rule that injects it, or to nil (any method) if one of those rules does not
+// restrict methods.
+func (c *Config) AllowedMethodsFromRules() (map[string][]string, error) {
+	result := make(map[string][]string)
+	unrestricted := make(map[string]bool)
+
+	for _, rule := range c.Rules {
+		secretNames, err := rule.Inject.SecretNames()
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		for _, secretName := range secretNames {
+			if len(rule.Match.Methods) == 0 {
+				unrestricted[secretName] = true
+			}
+			if unrestricted[secretName] {
+				result[secretName] = nil
+				continue
+			}
+			for _, m := range rule.Match.Methods {
+				if !slices.Contains(result[secretName], m) {
+					result[secretName] = append(result[secretName], m)
+				}
+			}
+			slices.Sort(result[secretName])
+		}
+	}
+	return result, nil
+}
 
-// extractSecretNames finds all secret names referenced in an Inject block.
-func extractSecretNames(inject Inject) ([]string, error) {
+// SecretNames returns every secret name the Inject block references, in
+// templates and in signing blocks. It fails if any template does not parse or
+// a signing block is incomplete.
+func (in Inject) SecretNames() ([]string, error) {
 	seen := make(map[string]struct{})
 	var names []string
 
-	collect := func(tmpl string) {
-		for _, match := range secretsTemplateRe.FindAllStringSubmatch(tmpl, -1) {
-			name := match[1]
+	add := func(list []string) {
+		for _, name := range list {
 			if _, ok := seen[name]; !ok {
 				seen[name] = struct{}{}
 				names = append(names, name)
 			}
 		}
 	}
+	collect := func(kind, key, tmplStr string) error {
+		t, err := tmpl.Parse(tmplStr)
+		if err != nil {
+			return fmt.Errorf("inject %s %q: %w", kind, key, err)
+		}
+		add(t.SecretNames())
+		return nil
+	}
 
-	for _, v := range inject.Headers {
-		collect(v)
+	for k, v := range in.Headers {
+		if err := collect("header", k, v); err != nil {
+			return nil, err
+		}
 	}
-	for _, v := range inject.QueryParams {
-		collect(v)
+	for k, v := range in.QueryParams {
+		if err := collect("query parameter", k, v); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range in.Cookies {
+		if !cookieNameRe.MatchString(k) {
+			return nil, fmt.Errorf("inject cookie %q: invalid cookie name", k)
+		}
+		if err := collect("cookie", k, v); err != nil {
+			return nil, err
+		}
+	}
+	if in.CaptureSetCookies && len(in.Cookies) == 0 {
+		return nil, fmt.Errorf("capture_set_cookies requires inject.cookies")
+	}
+	if in.Body != nil {
+		if err := in.Body.validate(); err != nil {
+			return nil, err
+		}
+		for k, v := range in.Body.JSON {
+			if err := collect("body json field", k, v); err != nil {
+				return nil, err
+			}
+		}
+		for k, v := range in.Body.Form {
+			if err := collect("body form field", k, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := in.validateAuthorization(); err != nil {
+		return nil, err
+	}
+	if in.AWSSigV4 != nil {
+		if err := in.AWSSigV4.validate(); err != nil {
+			return nil, err
+		}
+		add(in.AWSSigV4.SecretNames())
+	}
+	if in.OAuth2ClientCredentials != nil {
+		if err := in.OAuth2ClientCredentials.validate(); err != nil {
+			return nil, err
+		}
+		add([]string{in.OAuth2ClientCredentials.ClientSecret})
+	}
+	if in.GitHubApp != nil {
+		if err := in.GitHubApp.validate(); err != nil {
+			return nil, err
+		}
+		add([]string{in.GitHubApp.PrivateKey})
+	}
+	if in.GoogleServiceAccount != nil {
+		if err := in.GoogleServiceAccount.validate(); err != nil {
+			return nil, err
+		}
+		add([]string{in.GoogleServiceAccount.Key})
+	}
+	if in.HMAC != nil {
+		if err := in.HMAC.validate(); err != nil {
+			return nil, err
+		}
+		add([]string{in.HMAC.Key})
+	}
+	if in.ClientCertificate != nil {
+		if err := in.ClientCertificate.validate(); err != nil {
+			return nil, err
+		}
+		add([]string{in.ClientCertificate.Cert, in.ClientCertificate.Key})
 	}
 	return names, nil
 }
-
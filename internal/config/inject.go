@@ -0,0 +1,379 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// secretNameRe matches a bare secret name, as used by signing blocks.
+var secretNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// cookieNameRe matches a cookie name (an RFC 7230 token).
+var cookieNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// AWSSigV4 signs matching requests with AWS Signature Version 4 using sealed
+// credentials, replacing any signature the agent sent.
+type AWSSigV4 struct {
+	// AccessKeyID, SecretAccessKey and SessionToken name sealed secrets.
+	// SessionToken is only needed for temporary credentials.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token,omitempty"`
+	// Region and Service form the credential scope. Either may be left empty
+	// for *.amazonaws.com hosts, where it is inferred from the host name.
+	Region  string `yaml:"region,omitempty"`
+	Service string `yaml:"service,omitempty"`
+}
+
+// SecretNames returns the secrets a signs with.
+func (a *AWSSigV4) SecretNames() []string {
+	names := []string{a.AccessKeyID, a.SecretAccessKey}
+	if a.SessionToken != "" {
+		names = append(names, a.SessionToken)
+	}
+	return names
+}
+
+func (a *AWSSigV4) validate() error {
+	if a.AccessKeyID == "" || a.SecretAccessKey == "" {
+		return fmt.Errorf("aws_sigv4: access_key_id and secret_access_key are required")
+	}
+	for _, name := range a.SecretNames() {
+		if !secretNameRe.MatchString(name) {
+			return fmt.Errorf("aws_sigv4: invalid secret name %q", name)
+		}
+	}
+	return nil
+}
+
+// OAuth2 client authentication styles accepted by OAuth2ClientCredentials.AuthStyle.
+const (
+	OAuth2AuthBasic = "basic"
+	OAuth2AuthBody  = "body"
+)
+
+// OAuth2ClientCredentials mints access tokens from a sealed client secret
+// with the OAuth 2.0 client credentials grant and injects them as
+// Authorization: Bearer. Tokens are cached until shortly before they expire.
+type OAuth2ClientCredentials struct {
+	// TokenURL is the https token endpoint. Its host is committed to the
+	// sealed allowlist of ClientSecret alongside the rule's hosts.
+	TokenURL string `yaml:"token_url"`
+	ClientID string `yaml:"client_id"`
+	// ClientSecret names the sealed client secret.
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes,omitempty"`
+	// Params adds form parameters to the token request (e.g. audience or resource).
+	Params map[string]string `yaml:"params,omitempty"`
+	// AuthStyle is OAuth2AuthBasic (the default) to authenticate the client
+	// with HTTP Basic auth, or OAuth2AuthBody to send client_id and
+	// client_secret as form parameters.
+	AuthStyle string `yaml:"auth_style,omitempty"`
+}
+
+// TokenHost returns the host name of the token endpoint.
+func (o *OAuth2ClientCredentials) TokenHost() string {
+	u, err := url.Parse(o.TokenURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func (o *OAuth2ClientCredentials) validate() error {
+	u, err := url.Parse(o.TokenURL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("oauth2_client_credentials: token_url %q must be an https URL", o.TokenURL)
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("oauth2_client_credentials: client_id is required")
+	}
+	if !secretNameRe.MatchString(o.ClientSecret) {
+		return fmt.Errorf("oauth2_client_credentials: invalid client_secret name %q", o.ClientSecret)
+	}
+	switch o.AuthStyle {
+	case "", OAuth2AuthBasic, OAuth2AuthBody:
+	default:
+		return fmt.Errorf("oauth2_client_credentials: invalid auth_style %q (want %q or %q)",
+			o.AuthStyle, OAuth2AuthBasic, OAuth2AuthBody)
+	}
+	return nil
+}
+
+// DefaultGitHubAPIURL is the GitHub REST API used when GitHubApp.APIURL is empty.
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubApp mints GitHub App installation access tokens from a sealed app
+// private key. Requests to the REST API get Authorization: Bearer; any other
+// request to a rule host (git over HTTPS) gets Basic x-access-token auth.
+type GitHubApp struct {
+	// AppID is the app's numeric ID or client ID, used as the JWT issuer.
+	AppID          string `yaml:"app_id"`
+	InstallationID int64  `yaml:"installation_id"`
+	// PrivateKey names the sealed PEM private key of the app.
+	PrivateKey string `yaml:"private_key"`
+	// Repositories and Permissions optionally narrow the installation token,
+	// e.g. repositories: [botlockbox], permissions: {contents: read}.
+	Repositories []string          `yaml:"repositories,omitempty"`
+	Permissions  map[string]string `yaml:"permissions,omitempty"`
+	// APIURL is the REST API root, for GitHub Enterprise Server
+	// (e.g. https://github.example.com/api/v3). Defaults to DefaultGitHubAPIURL.
+	APIURL string `yaml:"api_url,omitempty"`
+}
+
+// API returns the parsed REST API root.
+func (g *GitHubApp) API() *url.URL {
+	raw := g.APIURL
+	if raw == "" {
+		raw = DefaultGitHubAPIURL
+	}
+	u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+	if err != nil {
+		return &url.URL{}
+	}
+	return u
+}
+
+func (g *GitHubApp) validate() error {
+	if g.AppID == "" || g.InstallationID <= 0 {
+		return fmt.Errorf("github_app: app_id and installation_id are required")
+	}
+	if !secretNameRe.MatchString(g.PrivateKey) {
+		return fmt.Errorf("github_app: invalid private_key name %q", g.PrivateKey)
+	}
+	if api := g.API(); api.Scheme != "https" || api.Hostname() == "" {
+		return fmt.Errorf("github_app: api_url %q must be an https URL", g.APIURL)
+	}
+	return nil
+}
+
+// DefaultGoogleTokenURL is the token endpoint used when
+// GoogleServiceAccount.TokenURL is empty.
+const DefaultGoogleTokenURL = "https://oauth2.googleapis.com/token"
+
+// GoogleServiceAccount mints Google OAuth access tokens from a sealed
+// service-account JSON key with the JWT bearer flow (RFC 7523) and injects
+// them as Authorization: Bearer.
+type GoogleServiceAccount struct {
+	// Key names the sealed service-account JSON key.
+	Key    string   `yaml:"key"`
+	Scopes []string `yaml:"scopes"`
+	// Subject is the Workspace user to impersonate with domain-wide delegation.
+	Subject string `yaml:"subject,omitempty"`
+	// TokenURL is the token endpoint; the key's own token_uri is ignored so
+	// that the endpoint can be sealed. Defaults to DefaultGoogleTokenURL.
+	TokenURL string `yaml:"token_url,omitempty"`
+}
+
+// Endpoint returns the token endpoint URL.
+func (g *GoogleServiceAccount) Endpoint() string {
+	if g.TokenURL == "" {
+		return DefaultGoogleTokenURL
+	}
+	return g.TokenURL
+}
+
+// TokenHost returns the host name of the token endpoint.
+func (g *GoogleServiceAccount) TokenHost() string {
+	u, err := url.Parse(g.Endpoint())
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func (g *GoogleServiceAccount) validate() error {
+	if !secretNameRe.MatchString(g.Key) {
+		return fmt.Errorf("google_service_account: invalid key name %q", g.Key)
+	}
+	if len(g.Scopes) == 0 {
+		return fmt.Errorf("google_service_account: at least one scope is required")
+	}
+	u, err := url.Parse(g.Endpoint())
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("google_service_account: token_url %q must be an https URL", g.TokenURL)
+	}
+	return nil
+}
+
+// HMAC request-signing components accepted in HMAC.Components. A component
+// may also be "header:NAME" (the request header's value) or "literal:TEXT".
+const (
+	HMACMethod     = "method"      // upper-case request method
+	HMACHost       = "host"        // request host, without port
+	HMACPath       = "path"        // escaped request path
+	HMACQuery      = "query"       // raw query string, without "?"
+	HMACPathQuery  = "path_query"  // escaped path, plus "?query" if there is one
+	HMACTimestamp  = "timestamp"   // signing time, formatted per TimestampFormat
+	HMACBody       = "body"        // raw request body
+	HMACBodySHA256 = "body_sha256" // hex SHA-256 of the request body
+)
+
+// HMAC signs matching requests with a sealed key. The string to sign is
+// Components joined by Separator; the encoded signature is set on
+// SignatureHeader and the timestamp, if any, on TimestampHeader.
+type HMAC struct {
+	// Key names the sealed signing key.
+	Key string `yaml:"key"`
+	// KeyEncoding is how the sealed key is stored: "raw" (default), "base64" or "hex".
+	KeyEncoding string `yaml:"key_encoding,omitempty"`
+	// Hash is "sha256" (default) or "sha512".
+	Hash       string   `yaml:"hash,omitempty"`
+	Components []string `yaml:"components"`
+	// Separator joins the components; it defaults to "\n" and may be "".
+	Separator *string `yaml:"separator,omitempty"`
+	// Encoding of the signature: "hex" (default), "base64" or "base64url".
+	Encoding        string `yaml:"encoding,omitempty"`
+	SignatureHeader string `yaml:"signature_header"`
+	// SignaturePrefix is prepended to the encoded signature (e.g. "sha256=").
+	SignaturePrefix string `yaml:"signature_prefix,omitempty"`
+	TimestampHeader string `yaml:"timestamp_header,omitempty"`
+	// TimestampFormat is "unix" (default), "unix_ms" or "rfc3339".
+	TimestampFormat string `yaml:"timestamp_format,omitempty"`
+}
+
+// Sep returns the component separator.
+func (h *HMAC) Sep() string {
+	if h.Separator == nil {
+		return "\n"
+	}
+	return *h.Separator
+}
+
+// SignsBody reports whether the request body is part of the string to sign.
+func (h *HMAC) SignsBody() bool {
+	return slices.Contains(h.Components, HMACBody) || slices.Contains(h.Components, HMACBodySHA256)
+}
+
+func (h *HMAC) validate() error {
+	if !secretNameRe.MatchString(h.Key) {
+		return fmt.Errorf("hmac: invalid key name %q", h.Key)
+	}
+	if h.SignatureHeader == "" {
+		return fmt.Errorf("hmac: signature_header is required")
+	}
+	if len(h.Components) == 0 {
+		return fmt.Errorf("hmac: at least one component is required")
+	}
+	for _, c := range h.Components {
+		switch {
+		case c == HMACMethod, c == HMACHost, c == HMACPath, c == HMACQuery, c == HMACPathQuery,
+			c == HMACTimestamp, c == HMACBody, c == HMACBodySHA256:
+		case strings.HasPrefix(c, "header:") && len(c) > len("header:"), strings.HasPrefix(c, "literal:"):
+		default:
+			return fmt.Errorf("hmac: unknown component %q", c)
+		}
+	}
+	for _, f := range []struct {
+		name, value string
+		allowed     []string
+	}{
+		{"key_encoding", h.KeyEncoding, []string{"raw", "base64", "hex"}},
+		{"hash", h.Hash, []string{"sha256", "sha512"}},
+		{"encoding", h.Encoding, []string{"hex", "base64", "base64url"}},
+		{"timestamp_format", h.TimestampFormat, []string{"unix", "unix_ms", "rfc3339"}},
+	} {
+		if f.value != "" && !slices.Contains(f.allowed, f.value) {
+			return fmt.Errorf("hmac: invalid %s %q (want one of %s)", f.name, f.value, strings.Join(f.allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// BodyInject sets request body fields from templates. Only the kind of
+// field that fits the request's Content-Type is set; a request whose body
+// fits neither configured kind is refused.
+type BodyInject struct {
+	// JSON maps a dotted path into a JSON body (e.g. "api_key" or
+	// "$.auth.client_secret") to a template. Missing objects on the path are
+	// created; array elements must already exist.
+	JSON map[string]string `yaml:"json,omitempty"`
+	// Form maps an application/x-www-form-urlencoded or multipart/form-data
+	// field name to a template. Agent fields of the same name are replaced.
+	Form map[string]string `yaml:"form,omitempty"`
+}
+
+func (b *BodyInject) validate() error {
+	if len(b.JSON) == 0 && len(b.Form) == 0 {
+		return fmt.Errorf("body: json or form is required")
+	}
+	for path := range b.JSON {
+		for _, key := range JSONPath(path) {
+			if key == "" {
+				return fmt.Errorf("body: invalid json path %q", path)
+			}
+		}
+	}
+	for name := range b.Form {
+		if name == "" {
+			return fmt.Errorf("body: empty form field name")
+		}
+	}
+	return nil
+}
+
+// JSONPath splits a dotted JSON path, optionally "$."-prefixed, into its keys.
+func JSONPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."), ".")
+}
+
+// ClientCertificate is a sealed TLS client certificate for upstream mTLS.
+// It is presented on every connection to a host that both the rule's host
+// patterns and the sealed allowlists of Cert and Key cover.
+type ClientCertificate struct {
+	// Cert names the sealed PEM certificate, optionally followed by its
+	// intermediate certificates.
+	Cert string `yaml:"cert"`
+	// Key names the sealed PEM private key (PKCS#1, SEC 1 or PKCS#8).
+	Key string `yaml:"key"`
+}
+
+func (c *ClientCertificate) validate() error {
+	for _, name := range []string{c.Cert, c.Key} {
+		if !secretNameRe.MatchString(name) {
+			return fmt.Errorf("client_certificate: invalid secret name %q", name)
+		}
+	}
+	return nil
+}
+
+// validateAuthorization rejects Inject blocks with more than one injection
+// type that sets Authorization.
+func (in Inject) validateAuthorization() error {
+	var set []string
+	if in.AWSSigV4 != nil {
+		set = append(set, "aws_sigv4")
+	}
+	if in.OAuth2ClientCredentials != nil {
+		set = append(set, "oauth2_client_credentials")
+	}
+	if in.GitHubApp != nil {
+		set = append(set, "github_app")
+	}
+	if in.GoogleServiceAccount != nil {
+		set = append(set, "google_service_account")
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("%s each set Authorization; use one per rule", strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// endpointHosts maps each secret the Inject block uses to authenticate to a
+// token endpoint to that endpoint's host.
+func (in Inject) endpointHosts() map[string][]string {
+	hosts := make(map[string][]string)
+	if o := in.OAuth2ClientCredentials; o != nil {
+		hosts[o.ClientSecret] = append(hosts[o.ClientSecret], o.TokenHost())
+	}
+	if g := in.GitHubApp; g != nil {
+		hosts[g.PrivateKey] = append(hosts[g.PrivateKey], g.API().Hostname())
+	}
+	if g := in.GoogleServiceAccount; g != nil {
+		hosts[g.Key] = append(hosts[g.Key], g.TokenHost())
+	}
+	return hosts
+}
@@ -30,6 +30,59 @@ func Load(path string) (*Config, error) {
 	}
 	cfg.SecretsFile = expandHome(cfg.SecretsFile)
 
+	switch cfg.Egress {
+	case "":
+		cfg.Egress = EgressAllow
+	case EgressAllow, EgressDeny:
+	default:
+		return nil, fmt.Errorf("invalid egress mode %q (want %q or %q)", cfg.Egress, EgressAllow, EgressDeny)
+	}
+
+	switch cfg.UnknownEncoding {
+	case "":
+		cfg.UnknownEncoding = UnknownEncodingStrip
+	case UnknownEncodingStrip, UnknownEncodingBlock, UnknownEncodingPass:
+	default:
+		return nil, fmt.Errorf("invalid unknown_encoding %q (want %q, %q or %q)", cfg.UnknownEncoding,
+			UnknownEncodingStrip, UnknownEncodingBlock, UnknownEncodingPass)
+	}
+
+	if cfg.LeafCache.Size == 0 {
+		cfg.LeafCache.Size = 1024
+	}
+	if cfg.LeafCache.Size < 0 {
+		return nil, fmt.Errorf("invalid leaf_cache.size %d (must be positive)", cfg.LeafCache.Size)
+	}
+
+	for i := range cfg.Rules {
+		for j, m := range cfg.Rules[i].Match.Methods {
+			if m == "" || strings.ContainsAny(m, " \t/") {
+				return nil, fmt.Errorf("rule %q: invalid method %q", cfg.Rules[i].Name, m)
+			}
+			cfg.Rules[i].Match.Methods[j] = strings.ToUpper(m)
+		}
+		match := &cfg.Rules[i].Match
+		for kind, preds := range map[string]map[string]*Predicate{
+			"header": match.Headers, "query parameter": match.Query, "json_body path": match.JSONBody,
+		} {
+			if err := compilePredicates(kind, preds); err != nil {
+				return nil, fmt.Errorf("rule %q: %w", cfg.Rules[i].Name, err)
+			}
+		}
+		if _, err := cfg.Rules[i].Inject.SecretNames(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", cfg.Rules[i].Name, err)
+		}
+	}
+
+	if err := compileScrubPatterns(cfg.Scrub); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Rules {
+		if err := compileScrubPatterns(cfg.Rules[i].Scrub); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", cfg.Rules[i].Name, err)
+		}
+	}
+
 	return &cfg, nil
 }
 
@@ -41,4 +94,4 @@ func expandHome(path string) string {
 		}
 	}
 	return path
-}
\ No newline at end of file
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Predicate tests one request value (a header, query parameter or JSON body
+// field). Exactly one of Exact, Prefix or Regex must be set.
+type Predicate struct {
+	Exact  string `yaml:"exact,omitempty"`
+	Prefix string `yaml:"prefix,omitempty"`
+	// Regex is a Go (RE2) regular expression; it is unanchored unless it uses ^ and $.
+	Regex string `yaml:"regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Compile validates the predicate and caches its compiled regex.
+// Load calls it for every predicate in every rule.
+func (p *Predicate) Compile() error {
+	set := 0
+	for _, v := range []string{p.Exact, p.Prefix, p.Regex} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of exact, prefix or regex must be set")
+	}
+	if p.Regex != "" {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return err
+		}
+		p.re = re
+	}
+	return nil
+}
+
+// Matches reports whether value satisfies the predicate.
+func (p *Predicate) Matches(value string) bool {
+	switch {
+	case p.Exact != "":
+		return value == p.Exact
+	case p.Prefix != "":
+		return strings.HasPrefix(value, p.Prefix)
+	case p.re != nil:
+		return p.re.MatchString(value)
+	case p.Regex != "":
+		ok, err := regexp.MatchString(p.Regex, value)
+		return err == nil && ok
+	}
+	return false
+}
+
+// compilePredicates compiles every predicate in m; kind names the map in errors.
+func compilePredicates(kind string, m map[string]*Predicate) error {
+	for key, p := range m {
+		if p == nil {
+			return fmt.Errorf("%s %q: empty predicate", kind, key)
+		}
+		if err := p.Compile(); err != nil {
+			return fmt.Errorf("%s %q: %w", kind, key, err)
+		}
+	}
+	return nil
+}
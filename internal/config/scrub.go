@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultScrubReplacement replaces every redacted match unless a pattern
+// sets its own Replacement.
+const DefaultScrubReplacement = "[REDACTED-BY-BOTLOCKBOX]"
+
+// ScrubPattern is a named regular expression redacted from response bodies.
+type ScrubPattern struct {
+	// Name identifies the pattern in audit events.
+	Name string `yaml:"name"`
+	// Pattern is a Go (RE2) regular expression.
+	Pattern string `yaml:"pattern"`
+	// Replacement is a regexp.Expand template, so "$1" or "${prefix}" keep
+	// parts of the match. Defaults to DefaultScrubReplacement.
+	Replacement string `yaml:"replacement,omitempty"`
+	// ContentTypes limits the pattern to responses of these media types
+	// ("text/*" style wildcards allowed). When empty the pattern applies to
+	// every text response.
+	ContentTypes []string `yaml:"content_types,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Compile validates the pattern and caches the compiled expression.
+// Load calls it for every configured pattern.
+func (p *ScrubPattern) Compile() error {
+	if p.Name == "" {
+		return fmt.Errorf("scrub pattern %q has no name", p.Pattern)
+	}
+	if p.Pattern == "" {
+		return fmt.Errorf("scrub pattern %q has an empty pattern", p.Name)
+	}
+	re, err := regexp.Compile(p.Pattern)
+	if err != nil {
+		return fmt.Errorf("scrub pattern %q: %w", p.Name, err)
+	}
+	if p.Replacement == "" {
+		p.Replacement = DefaultScrubReplacement
+	}
+	// The streaming scrubber rescans recent output, so a replacement its own
+	// pattern matches would be redacted (and counted) again.
+	if !strings.Contains(p.Replacement, "$") && re.MatchString(p.Replacement) {
+		return fmt.Errorf("scrub pattern %q matches its own replacement %q", p.Name, p.Replacement)
+	}
+	for _, ct := range p.ContentTypes {
+		if !strings.Contains(ct, "/") {
+			return fmt.Errorf("scrub pattern %q: invalid content type %q", p.Name, ct)
+		}
+	}
+	p.re = re
+	return nil
+}
+
+// Regexp returns the compiled pattern, or nil if Compile has not succeeded.
+func (p *ScrubPattern) Regexp() *regexp.Regexp {
+	return p.re
+}
+
+// compileScrubPatterns compiles patterns and rejects duplicate names.
+func compileScrubPatterns(patterns []ScrubPattern) error {
+	seen := make(map[string]struct{}, len(patterns))
+	for i := range patterns {
+		if err := patterns[i].Compile(); err != nil {
+			return err
+		}
+		if _, dup := seen[patterns[i].Name]; dup {
+			return fmt.Errorf("duplicate scrub pattern name %q", patterns[i].Name)
+		}
+		seen[patterns[i].Name] = struct{}{}
+	}
+	return nil
+}
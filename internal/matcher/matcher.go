@@ -1,7 +1,11 @@
 package matcher
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/trodemaster/botlockbox/internal/config"
@@ -10,21 +14,63 @@ import (
 // Matches returns true if the request matches the given match criteria.
 func Matches(req *http.Request, match config.Match) bool {
 	host := req.URL.Hostname()
-	hostMatched := false
-	for _, pattern := range match.Hosts {
-		if HostMatches(host, pattern) {
-			hostMatched = true
-			break
-		}
+	if !HostMatchesAny(host, match.Hosts) {
+		return false
 	}
-	if !hostMatched {
+	if !MethodMatches(req.Method, match.Methods) {
 		return false
 	}
-	if len(match.PathPrefixes) == 0 {
+	if !pathMatches(req.URL.Path, match.PathPrefixes) {
+		return false
+	}
+	for name, p := range match.Headers {
+		if !anyMatches(p, req.Header.Values(name)) {
+			return false
+		}
+	}
+	if len(match.Query) > 0 {
+		query := req.URL.Query()
+		for name, p := range match.Query {
+			if !anyMatches(p, query[name]) {
+				return false
+			}
+		}
+	}
+	if len(match.JSONBody) > 0 {
+		return jsonBodyMatches(req, match.JSONBody)
+	}
+	return true
+}
+
+func pathMatches(path string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyMatches(p *config.Predicate, values []string) bool {
+	for _, v := range values {
+		if p.Matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// MethodMatches reports whether method is one of methods (case-insensitive).
+// An empty methods list matches every method.
+func MethodMatches(method string, methods []string) bool {
+	if len(methods) == 0 {
 		return true
 	}
-	for _, prefix := range match.PathPrefixes {
-		if strings.HasPrefix(req.URL.Path, prefix) {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
 			return true
 		}
 	}
@@ -42,4 +88,86 @@ func HostMatches(host, pattern string) bool {
 		return strings.HasSuffix(host, suffix)
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// HostMatchesAny reports whether host matches at least one of patterns.
+func HostMatchesAny(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if HostMatches(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxMatchBodyBytes bounds how much of a request body json_body predicates
+// read. A larger body does not parse, so its predicates never match.
+const maxMatchBodyBytes = 1 << 20
+
+// jsonBodyMatches reads (and restores) req's body and evaluates preds against it.
+func jsonBodyMatches(req *http.Request, preds map[string]*config.Predicate) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxMatchBodyBytes+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil || len(body) > maxMatchBodyBytes {
+		return false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return false
+	}
+	for path, p := range preds {
+		v, ok := jsonLookup(doc, path)
+		if !ok || !p.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonLookup resolves a dotted path ("a.b.0.c", optionally "$."-prefixed) in
+// doc and returns the scalar it names as a string. Objects, arrays and
+// missing paths report false.
+func jsonLookup(doc any, path string) (string, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	cur := doc
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch node := cur.(type) {
+			case map[string]any:
+				next, ok := node[key]
+				if !ok {
+					return "", false
+				}
+				cur = next
+			case []any:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(node) {
+					return "", false
+				}
+				cur = node[i]
+			default:
+				return "", false
+			}
+		}
+	}
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
@@ -10,20 +10,40 @@ import (
 // AuditEvent records a credential injection attempt.
 // Secret VALUES are never logged -- only names.
 type AuditEvent struct {
-	Timestamp   time.Time `json:"ts"`
-	Host        string    `json:"host"`
-	Method      string    `json:"method"`
-	Path        string    `json:"path"`
-	RuleName    string    `json:"rule"`
-	SecretName  string    `json:"secret_name"`
-	Injected    bool      `json:"injected"`
-	Blocked     bool      `json:"blocked"`
-	BlockReason string    `json:"block_reason,omitempty"`
+	Timestamp  time.Time `json:"ts"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RuleName   string    `json:"rule"`
+	SecretName string    `json:"secret_name"`
+	// SecretNames lists every secret used when a template referenced more
+	// than one; SecretName is then the first of them.
+	SecretNames []string `json:"secret_names,omitempty"`
+	Injected    bool     `json:"injected"`
+	Blocked     bool     `json:"blocked"`
+	BlockReason string   `json:"block_reason,omitempty"`
+	// StrippedHeaders lists agent-supplied header names removed before injection.
+	StrippedHeaders []string `json:"stripped_headers,omitempty"`
+	// Severity is set for events that need an operator's attention.
+	Severity string `json:"severity,omitempty"`
+	// Redactions counts response scrubber matches by pattern name.
+	Redactions map[string]int `json:"redactions,omitempty"`
+	// CapturedCookies lists upstream Set-Cookie names kept from the agent.
+	CapturedCookies []string `json:"captured_cookies,omitempty"`
 }
 
+// SeverityHigh marks audit events such as blocked exfiltration attempts.
+const SeverityHigh = "high"
+
 // LogAuditEvent emits a structured JSON audit log line.
 func LogAuditEvent(req *http.Request, ruleName, secretName string, injected, blocked bool, blockReason string) {
-	evt := AuditEvent{
+	newAuditEvent(req, ruleName, secretName, injected, blocked, blockReason).Log()
+}
+
+// newAuditEvent builds an AuditEvent for req; callers may set optional fields
+// before calling Log.
+func newAuditEvent(req *http.Request, ruleName, secretName string, injected, blocked bool, blockReason string) AuditEvent {
+	return AuditEvent{
 		Timestamp:   time.Now().UTC(),
 		Host:        req.URL.Hostname(),
 		Method:      req.Method,
@@ -34,6 +54,10 @@ func LogAuditEvent(req *http.Request, ruleName, secretName string, injected, blo
 		Blocked:     blocked,
 		BlockReason: blockReason,
 	}
+}
+
+// Log emits evt as a structured JSON audit log line.
+func (evt AuditEvent) Log() {
 	b, _ := json.Marshal(evt)
 	log.Printf("AUDIT %s", b)
-}
\ No newline at end of file
+}
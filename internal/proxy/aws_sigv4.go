@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
+	"github.com/trodemaster/botlockbox/internal/tmpl"
+)
+
+const (
+	sigv4Algorithm   = "AWS4-HMAC-SHA256"
+	sigv4TimeFormat  = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	unsignedTrailer  = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	streamingPayload = "STREAMING-"
+)
+
+// sigv4QueryParams are the presigned-URL parameters an agent may have sent;
+// they are dropped so only botlockbox's header signature reaches AWS.
+var sigv4QueryParams = []string{
+	"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires",
+	"X-Amz-Security-Token", "X-Amz-Signature", "X-Amz-SignedHeaders",
+}
+
+// sigv4Headers are the agent-supplied signing headers replaced on re-signing.
+var sigv4Headers = []string{"X-Amz-Content-Sha256", "X-Amz-Date", "X-Amz-Security-Token"}
+
+// awsRegionRe matches an AWS region name such as us-east-1 or us-gov-west-1.
+var awsRegionRe = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// awsSigningNames maps endpoint prefixes to the service name they sign with,
+// where the two differ.
+var awsSigningNames = map[string]string{
+	"bedrock-runtime":       "bedrock",
+	"bedrock-agent-runtime": "bedrock",
+	"s3-accesspoint":        "s3",
+	"s3-control":            "s3",
+}
+
+// signAWSv4 signs req with the rule's sealed AWS credentials, after checking
+// each against its sealed binding. Signature headers and presigned query
+// parameters sent by the agent are removed first. On failure it logs a
+// blocked audit event and returns the response to send instead.
+func (inj *Injector) signAWSv4(req *http.Request, rule config.Rule, body *requestBody) *http.Response {
+	cfg := rule.Inject.AWSSigV4
+	names := cfg.SecretNames()
+	host := req.URL.Hostname()
+	for _, name := range names {
+		if err := inj.assertBindingAllowed(name, host, req.Method); err != nil {
+			LogAuditEvent(req, rule.Name, name, false, true, err.Error())
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503,
+				"botlockbox: security block -- credential injection refused")
+		}
+	}
+
+	region, service := cfg.Region, cfg.Service
+	if region == "" || service == "" {
+		inferredRegion, inferredService, ok := inferAWSScope(host)
+		if !ok {
+			LogAuditEvent(req, rule.Name, names[0], false, true,
+				fmt.Sprintf("aws_sigv4: cannot infer region and service from host %q", host))
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: aws_sigv4 scope unknown")
+		}
+		if region == "" {
+			region = inferredRegion
+		}
+		if service == "" {
+			service = inferredService
+		}
+	}
+
+	payloadHash, err := sigv4PayloadHash(req, body, service)
+	if err != nil {
+		LogAuditEvent(req, rule.Name, names[0], false, true, "aws_sigv4: "+err.Error())
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusRequestEntityTooLarge,
+			"botlockbox: "+err.Error())
+	}
+	var stripped []string
+	for _, h := range sigv4Headers {
+		if _, ok := req.Header[h]; ok {
+			req.Header.Del(h)
+			stripped = append(stripped, h)
+		}
+	}
+	q := req.URL.Query()
+	for _, p := range sigv4QueryParams {
+		q.Del(p)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	bufs := make(map[string]*memguard.LockedBuffer, len(names))
+	defer func() {
+		for _, buf := range bufs {
+			buf.Destroy()
+		}
+	}()
+	for _, name := range names {
+		buf, err := inj.openSecret(name)
+		if err != nil {
+			LogAuditEvent(req, rule.Name, name, false, true, err.Error())
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: secret unavailable")
+		}
+		bufs[name] = buf
+	}
+	var sessionToken string
+	if cfg.SessionToken != "" {
+		sessionToken = string(bufs[cfg.SessionToken].Bytes())
+	}
+	signSigV4(req, sigv4Credentials{
+		accessKeyID:  string(bufs[cfg.AccessKeyID].Bytes()),
+		secretKey:    bufs[cfg.SecretAccessKey].Bytes(),
+		sessionToken: sessionToken,
+		region:       region,
+		service:      service,
+	}, payloadHash, time.Now())
+
+	evt := injectionEvent(req, rule.Name, names)
+	evt.StrippedHeaders = stripped
+	evt.Log()
+	return nil
+}
+
+// sigv4Credentials is the key material and scope for one signature.
+// secretKey is borrowed from a locked buffer; every key derived from it is
+// scrambled once used.
+type sigv4Credentials struct {
+	accessKeyID  string
+	secretKey    []byte
+	sessionToken string
+	region       string
+	service      string
+}
+
+// sigv4PayloadHash returns the x-amz-content-sha256 value for req. An
+// unsigned payload the agent declared is kept for S3, which accepts it; any
+// other streaming signature cannot be re-signed. A body too large to buffer
+// is sent unsigned to S3 and refused for other services.
+func sigv4PayloadHash(req *http.Request, body *requestBody, service string) (string, error) {
+	declared := req.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case service == "s3" && (declared == unsignedPayload || declared == unsignedTrailer):
+		return declared, nil
+	case strings.HasPrefix(declared, streamingPayload) && declared != unsignedTrailer:
+		return "", fmt.Errorf("cannot re-sign a %s request body", declared)
+	case body.streamed && service == "s3":
+		return unsignedPayload, nil
+	case body.streamed:
+		return "", fmt.Errorf("request body larger than %d bytes cannot be signed", maxGuardedBodyBytes)
+	}
+	sum := sha256.Sum256(body.head)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// signSigV4 adds the X-Amz-Date, X-Amz-Security-Token, X-Amz-Content-Sha256
+// (S3 only) and Authorization headers for creds to req. The path and query
+// are rewritten to their canonical encoding so the request AWS receives is
+// the one that was signed.
+func signSigV4(req *http.Request, creds sigv4Credentials, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format(sigv4TimeFormat)
+	date := amzDate[:8]
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil &&
+		(port == "443" && req.URL.Scheme == "https" || port == "80" && req.URL.Scheme == "http") {
+		host = h
+	}
+	req.Host = host
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	if creds.service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	path := sigv4EscapePath(req.URL.Path)
+	req.URL.RawPath = path
+	canonicalURI := path
+	if creds.service != "s3" {
+		// Every service but S3 signs the path URI-encoded twice.
+		canonicalURI = sigv4EscapePath(path)
+	}
+	req.URL.RawQuery = sigv4CanonicalQuery(req.URL.Query())
+
+	signedHeaders, canonicalHeaders := sigv4CanonicalHeaders(req.Header, host)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + creds.region + "/" + creds.service + "/aws4_request"
+	stringToSign := sigv4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := make([]byte, 0, 4+len(creds.secretKey))
+	key = append(append(key, "AWS4"...), creds.secretKey...)
+	for _, part := range []string{date, creds.region, creds.service, "aws4_request", stringToSign} {
+		next := hmacSHA256(key, part)
+		memguard.ScrambleBytes(key)
+		key = next
+	}
+	signature := hex.EncodeToString(key)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigv4Algorithm, creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sigv4CanonicalHeaders returns the signed header list and the canonical
+// header block. Host and every X-Amz-* header are signed.
+func sigv4CanonicalHeaders(h http.Header, host string) (signed, canonical string) {
+	values := map[string]string{"host": host}
+	for name, vs := range h {
+		lower := strings.ToLower(name)
+		if !strings.HasPrefix(lower, "x-amz-") {
+			continue
+		}
+		trimmed := make([]string, len(vs))
+		for i, v := range vs {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[lower] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + values[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+// sigv4CanonicalQuery encodes q sorted by encoded name and then encoded
+// value, with every byte outside the unreserved set percent-encoded. Sorting
+// whole "name=value" strings would be wrong: "a-b=" sorts before "a=".
+func sigv4CanonicalQuery(q url.Values) string {
+	type pair struct{ name, value string }
+	var pairs []pair
+	for name, vs := range q {
+		encoded := string(tmpl.PercentEncode([]byte(name)))
+		for _, v := range vs {
+			pairs = append(pairs, pair{encoded, string(tmpl.PercentEncode([]byte(v)))})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].name != pairs[j].name {
+			return pairs[i].name < pairs[j].name
+		}
+		return pairs[i].value < pairs[j].value
+	})
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.name + "=" + p.value
+	}
+	return strings.Join(parts, "&")
+}
+
+// sigv4EscapePath percent-encodes each segment of path, keeping the slashes.
+func sigv4EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = string(tmpl.PercentEncode([]byte(s)))
+	}
+	return strings.Join(segments, "/")
+}
+
+// inferAWSScope derives the signing region and service from an AWS endpoint
+// host such as sqs.eu-west-1.amazonaws.com or bucket.s3.us-west-2.amazonaws.com.
+// Global endpoints sign for us-east-1.
+func inferAWSScope(host string) (region, service string, ok bool) {
+	rest, found := strings.CutSuffix(host, ".amazonaws.com")
+	if !found {
+		rest, found = strings.CutSuffix(host, ".amazonaws.com.cn")
+	}
+	if !found || rest == "" {
+		return "", "", false
+	}
+	labels := strings.Split(rest, ".")
+	// Virtual-hosted S3 buckets put the bucket name first.
+	for i, l := range labels {
+		if l == "s3" || strings.HasPrefix(l, "s3-") {
+			labels = labels[i:]
+			break
+		}
+	}
+	service = labels[0]
+	if r, legacy := strings.CutPrefix(service, "s3-"); legacy && awsRegionRe.MatchString(r) {
+		service, region = "s3", r
+	}
+	if name, ok := awsSigningNames[service]; ok {
+		service = name
+	}
+	for _, l := range labels[1:] {
+		if region != "" {
+			break
+		}
+		if awsRegionRe.MatchString(l) {
+			region = l
+		}
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return region, service, true
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// injectBody sets the rule's body fields in req and re-frames the body,
+// updating body.head so that signing covers the rewritten body. The fields
+// set are those of the kind the request's Content-Type fits; any other
+// content type, or a body that does not parse as that type, is refused and
+// audited.
+func (inj *Injector) injectBody(req *http.Request, rule config.Rule, body *requestBody) *http.Response {
+	cfg := rule.Inject.Body
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	var fields map[string]string
+	var rewrite func(head []byte, values map[string]string) ([]byte, error)
+	switch {
+	case len(cfg.JSON) > 0 && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")):
+		fields, rewrite = cfg.JSON, setJSONFields
+	case len(cfg.Form) > 0 && mediaType == "application/x-www-form-urlencoded":
+		fields, rewrite = cfg.Form, setURLEncodedFields
+	case len(cfg.Form) > 0 && mediaType == "multipart/form-data" && params["boundary"] != "":
+		fields = cfg.Form
+		rewrite = func(head []byte, values map[string]string) ([]byte, error) {
+			return setMultipartFields(head, params["boundary"], values)
+		}
+	default:
+		reason := fmt.Sprintf("body: content type %q does not fit inject.body", mediaType)
+		LogAuditEvent(req, rule.Name, "", false, true, reason)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusUnsupportedMediaType,
+			"botlockbox: security block -- request content type does not fit body injection")
+	}
+	if body.streamed {
+		reason := fmt.Sprintf("request body larger than %d bytes cannot be rewritten", maxGuardedBodyBytes)
+		LogAuditEvent(req, rule.Name, "", false, true, "body: "+reason)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusRequestEntityTooLarge,
+			"botlockbox: "+reason)
+	}
+
+	values := make(map[string]string, len(fields))
+	var names [][]string
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		rendered, secretNames, resp := inj.render(req, rule, fields[field])
+		if resp != nil {
+			return resp
+		}
+		values[field] = rendered
+		names = append(names, secretNames)
+	}
+	head, err := rewrite(body.head, values)
+	if err != nil {
+		LogAuditEvent(req, rule.Name, "", false, true, "body: "+err.Error())
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest,
+			"botlockbox: "+err.Error())
+	}
+
+	body.head = head
+	req.Body = io.NopCloser(bytes.NewReader(head))
+	req.ContentLength = int64(len(head))
+	req.TransferEncoding = nil
+	if req.Header.Get("Content-Length") != "" {
+		req.Header.Set("Content-Length", strconv.Itoa(len(head)))
+	}
+	for _, n := range names {
+		logInjection(req, rule.Name, n)
+	}
+	return nil
+}
+
+// setJSONFields sets each dotted path in values to its string value in the
+// JSON document head, which must be an object or array (an empty body counts
+// as an empty object), and re-encodes it.
+func setJSONFields(head []byte, values map[string]string) ([]byte, error) {
+	var doc any = map[string]any{}
+	if len(bytes.TrimSpace(head)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(head))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("request body is not valid JSON")
+		}
+	}
+	switch doc.(type) {
+	case map[string]any, []any:
+	default:
+		return nil, fmt.Errorf("request body is not a JSON object or array")
+	}
+	for _, path := range slices.Sorted(maps.Keys(values)) {
+		var ok bool
+		if doc, ok = jsonSet(doc, config.JSONPath(path), values[path]); !ok {
+			return nil, fmt.Errorf("request body has no JSON path %q", path)
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonSet returns node with keys set to value, creating missing objects
+// along the way. It reports false if keys cross a scalar or an array index
+// that does not exist.
+func jsonSet(node any, keys []string, value any) (any, bool) {
+	if len(keys) == 0 {
+		return value, true
+	}
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := jsonSet(n[keys[0]], keys[1:], value)
+		n[keys[0]] = child
+		return n, ok
+	case []any:
+		i, err := strconv.Atoi(keys[0])
+		if err != nil || i < 0 || i >= len(n) {
+			return n, false
+		}
+		child, ok := jsonSet(n[i], keys[1:], value)
+		n[i] = child
+		return n, ok
+	case nil:
+		return jsonSet(map[string]any{}, keys, value)
+	}
+	return node, false
+}
+
+// setURLEncodedFields replaces the fields named in values in an urlencoded
+// body. The agent's other fields keep their order and encoding; the injected
+// fields follow them.
+func setURLEncodedFields(head []byte, values map[string]string) ([]byte, error) {
+	var pairs []string
+	for _, pair := range strings.Split(string(head), "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			return nil, fmt.Errorf("request body is not valid urlencoded form data")
+		}
+		if _, ok := values[name]; !ok {
+			pairs = append(pairs, pair)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(values[name]))
+	}
+	return []byte(strings.Join(pairs, "&")), nil
+}
+
+// setMultipartFields replaces the non-file fields named in values in a
+// multipart/form-data body, keeping every other part byte for byte and the
+// same boundary. The injected fields follow the agent's parts.
+func setMultipartFields(head []byte, boundary string, values map[string]string) ([]byte, error) {
+	r := multipart.NewReader(bytes.NewReader(head), boundary)
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("request body is not valid multipart form data")
+		}
+		if _, ok := values[part.FormName()]; ok && part.FileName() == "" {
+			continue
+		}
+		pw, err := w.CreatePart(part.Header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(pw, part); err != nil {
+			return nil, fmt.Errorf("request body is not valid multipart form data")
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if err := w.WriteField(name, values[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
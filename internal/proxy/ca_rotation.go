@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/matcher"
+)
+
+// caRotationOverlap is how long before the active CA expires its successor is
+// generated. The retired CA stays in the trust bundle until it expires, so
+// clients have this long to pick up the new certificate.
+const caRotationOverlap = 6 * time.Hour
+
+// issuedCA is a CA together with its parsed certificate and PEM.
+// Generated CAs carry their private key in cert.PrivateKey; CAs loaded from
+// the sealed envelope keep it in sealedKey instead.
+type issuedCA struct {
+	cert      *tls.Certificate
+	sealedKey *memguard.Enclave
+	pem       []byte
+	notAfter  time.Time
+}
+
+// sign issues a leaf certificate for host.
+func (ca issuedCA) sign(host string) (*tls.Certificate, error) {
+	if ca.sealedKey == nil {
+		return signLeaf(ca.cert, ca.cert.PrivateKey, host)
+	}
+	var leaf *tls.Certificate
+	err := ca.withKey(func(key crypto.Signer) error {
+		var err error
+		leaf, err = signLeaf(ca.cert, key, host)
+		return err
+	})
+	return leaf, err
+}
+
+// CAManager owns the MITM CA used to sign leaf certificates and can replace it
+// with a freshly generated successor without restarting the proxy.
+type CAManager struct {
+	mu      sync.RWMutex
+	current issuedCA
+	retired []issuedCA
+
+	// permittedHosts, when non-nil, are baked into every generated CA as
+	// X.509 name constraints.
+	permittedHosts []string
+
+	// leaves caches signed leaf certificates; it is purged on rotation and
+	// re-warmed with prewarmHosts.
+	leaves       *leafCache
+	prewarmHosts []string
+}
+
+// NewCAManager generates the initial ephemeral CA. A non-nil permittedHosts
+// name-constrains it (and every successor) to those host patterns.
+// Up to leafCacheSize signed leaf certificates are cached by hostname.
+func NewCAManager(permittedHosts []string, leafCacheSize int) (*CAManager, error) {
+	m := &CAManager{
+		permittedHosts: permittedHosts,
+		leaves:         newLeafCache(leafCacheSize),
+	}
+	ca, err := newIssuedCA(permittedHosts)
+	if err != nil {
+		return nil, err
+	}
+	m.current = ca
+	return m, nil
+}
+
+func newIssuedCA(permittedHosts []string) (issuedCA, error) {
+	cert, certPEM, err := GenerateEphemeralCA(permittedHosts)
+	if err != nil {
+		return issuedCA{}, fmt.Errorf("generating ephemeral CA: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return issuedCA{}, fmt.Errorf("parsing ephemeral CA: %w", err)
+	}
+	cert.Leaf = leaf
+	return issuedCA{cert: cert, pem: certPEM, notAfter: leaf.NotAfter}, nil
+}
+
+// Rotate generates a successor CA and makes it the signing CA for new MITM
+// handshakes. The previous CA is kept in BundlePEM until it expires.
+func (m *CAManager) Rotate() error {
+	if !m.Rotatable() {
+		return errSealedCA
+	}
+	next, err := newIssuedCA(m.permittedHosts)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.pruneRetired(time.Now())
+	m.retired = append(m.retired, m.current)
+	m.current = next
+	m.leaves.purge()
+	m.mu.Unlock()
+	return m.warm()
+}
+
+// Rotatable reports whether the CA is generated by serve and can be rotated,
+// as opposed to a persistent CA loaded from the sealed envelope.
+func (m *CAManager) Rotatable() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current.sealedKey == nil
+}
+
+// Prewarm signs and caches leaf certificates for hosts now, and again after
+// every rotation, so the first handshake to each host skips signing.
+func (m *CAManager) Prewarm(hosts []string) error {
+	m.mu.Lock()
+	m.prewarmHosts = hosts
+	m.mu.Unlock()
+	return m.warm()
+}
+
+func (m *CAManager) warm() error {
+	m.mu.RLock()
+	hosts := m.prewarmHosts
+	m.mu.RUnlock()
+	for _, host := range hosts {
+		if _, err := m.sign(host); err != nil {
+			return fmt.Errorf("pre-warming leaf certificate for %q: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// leafFor returns a leaf certificate for host, from the cache when possible.
+func (m *CAManager) leafFor(host string) (*tls.Certificate, error) {
+	if cert := m.leaves.get(host); cert != nil {
+		return cert, nil
+	}
+	return m.sign(host)
+}
+
+// sign issues a leaf for host with the active CA and caches it, unless the
+// CA rotated while signing.
+func (m *CAManager) sign(host string) (*tls.Certificate, error) {
+	m.mu.RLock()
+	ca := m.current
+	m.mu.RUnlock()
+
+	cert, err := ca.sign(host)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	if m.current.cert == ca.cert {
+		m.leaves.put(host, cert)
+	}
+	m.mu.RUnlock()
+	return cert, nil
+}
+
+// LeafCacheStats returns the leaf cache hit and miss counts and its current size.
+func (m *CAManager) LeafCacheStats() (hits, misses uint64, size int) {
+	return m.leaves.hits.Load(), m.leaves.misses.Load(), m.leaves.len()
+}
+
+// Permits reports whether clients will accept a leaf certificate for host
+// signed by this CA, i.e. whether host is inside its name constraints.
+func (m *CAManager) Permits(host string) bool {
+	return m.permittedHosts == nil || matcher.HostMatchesAny(host, m.permittedHosts)
+}
+
+// RotateAt returns when the active CA should be replaced.
+func (m *CAManager) RotateAt() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current.notAfter.Add(-caRotationOverlap)
+}
+
+// NextChange returns the next time the CA set changes on its own: either the
+// scheduled rotation or the expiry of a retired CA, whichever comes first.
+// Expired retired CAs are dropped, so the result is never an expiry that has
+// already passed.
+func (m *CAManager) NextChange() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneRetired(time.Now())
+	next := m.current.notAfter.Add(-caRotationOverlap)
+	for _, ca := range m.retired {
+		if ca.notAfter.Before(next) {
+			next = ca.notAfter
+		}
+	}
+	return next
+}
+
+// BundlePEM returns the PEM certificates clients should trust: the active CA
+// followed by any retired CAs that have not yet expired. Expired retired CAs
+// are dropped.
+func (m *CAManager) BundlePEM() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneRetired(time.Now())
+
+	var buf bytes.Buffer
+	buf.Write(m.current.pem)
+	for _, ca := range m.retired {
+		buf.Write(ca.pem)
+	}
+	return buf.Bytes()
+}
+
+// pruneRetired drops retired CAs that expired by now. Callers must hold m.mu
+// for writing.
+func (m *CAManager) pruneRetired(now time.Time) {
+	live := m.retired[:0]
+	for _, ca := range m.retired {
+		if ca.notAfter.After(now) {
+			live = append(live, ca)
+		}
+	}
+	m.retired = live
+}
+
+// TLSConfig is a goproxy ConnectAction TLSConfig function that serves a leaf
+// certificate signed by whichever CA is active at handshake time.
+func (m *CAManager) TLSConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	hostname := hostnameOf(host)
+	cert, err := m.leafFor(hostname)
+	if err != nil {
+		ctx.Warnf("Cannot sign leaf certificate for %s: %v", hostname, err)
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// bundleCerts parses every certificate in a PEM bundle.
+func bundleCerts(t *testing.T, bundle []byte) []*x509.Certificate {
+	t.Helper()
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certs
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("parsing bundle certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+}
+
+func TestCAManager_RotateKeepsRetiredInBundle(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewCAManager(nil, 16)
+	if err != nil {
+		t.Fatalf("NewCAManager: %v", err)
+	}
+	before := bundleCerts(t, m.BundlePEM())
+	if len(before) != 1 {
+		t.Fatalf("initial bundle has %d certs, want 1", len(before))
+	}
+
+	if err := m.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	after := bundleCerts(t, m.BundlePEM())
+	if len(after) != 2 {
+		t.Fatalf("bundle after rotation has %d certs, want 2", len(after))
+	}
+	if !after[1].Equal(before[0]) {
+		t.Error("retired CA is not the second certificate in the bundle")
+	}
+	if after[0].Equal(before[0]) {
+		t.Error("active CA did not change after rotation")
+	}
+	if m.NextChange().After(m.RotateAt()) {
+		t.Error("NextChange is later than the next scheduled rotation")
+	}
+}
+
+// TestCAManager_NextChangeDropsExpiredRetired runs the serve rotation loop's
+// wait computation without ever writing a bundle: once a retired CA expires,
+// NextChange must move on rather than keep returning the past expiry.
+func TestCAManager_NextChangeDropsExpiredRetired(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewCAManager(nil, 16)
+	if err != nil {
+		t.Fatalf("NewCAManager: %v", err)
+	}
+	if err := m.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	m.mu.Lock()
+	m.retired[0].notAfter = time.Now().Add(-time.Minute)
+	m.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		next := m.NextChange()
+		if wait := time.Until(next); wait <= 0 {
+			t.Fatalf("iteration %d: NextChange is %v in the past; the rotation loop would spin", i, -wait)
+		}
+		if time.Now().Before(m.RotateAt()) && !next.Equal(m.RotateAt()) {
+			t.Errorf("iteration %d: NextChange = %v, want the scheduled rotation %v", i, next, m.RotateAt())
+		}
+	}
+	if n := len(bundleCerts(t, m.BundlePEM())); n != 1 {
+		t.Errorf("bundle has %d certs after the retired CA expired, want 1", n)
+	}
+}
+
+func TestCAManager_TLSConfigSignsWithActiveCA(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewCAManager(nil, 16)
+	if err != nil {
+		t.Fatalf("NewCAManager: %v", err)
+	}
+	if err := m.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	active := bundleCerts(t, m.BundlePEM())[0]
+
+	ctx := &goproxy.ProxyCtx{
+		Req:   httptest.NewRequest(http.MethodConnect, "http://api.example.com:443", nil),
+		Proxy: goproxy.NewProxyHttpServer(),
+	}
+	tlsCfg, err := m.TLSConfig("api.example.com:443", ctx)
+	if err != nil {
+		t.Fatalf("TLSConfig: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(tlsCfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing leaf: %v", err)
+	}
+	if err := leaf.CheckSignatureFrom(active); err != nil {
+		t.Errorf("leaf not signed by active CA: %v", err)
+	}
+}
+
+func TestCAManager_NameConstraints(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewCAManager([]string{"api.github.com", "*.openai.com"}, 16)
+	if err != nil {
+		t.Fatalf("NewCAManager: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(m.BundlePEM())
+
+	cases := []struct {
+		host    string
+		wantErr bool
+	}{
+		{"api.github.com", false},
+		{"api.openai.com", false},
+		{"openai.com", true}, // "*.openai.com" covers subdomains only
+		{"www.google.com", true},
+	}
+	for _, tc := range cases {
+		ctx := &goproxy.ProxyCtx{
+			Req:   httptest.NewRequest(http.MethodConnect, tc.host+":443", nil),
+			Proxy: goproxy.NewProxyHttpServer(),
+		}
+		tlsCfg, err := m.TLSConfig(tc.host+":443", ctx)
+		if err != nil {
+			t.Fatalf("TLSConfig(%q): %v", tc.host, err)
+		}
+		leaf, err := x509.ParseCertificate(tlsCfg.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatalf("parsing leaf: %v", err)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: tc.host, Roots: roots})
+		if tc.wantErr && err == nil {
+			t.Errorf("%s: leaf verified, want name constraint violation", tc.host)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("%s: unexpected verify error: %v", tc.host, err)
+		}
+		if got := m.Permits(tc.host); got == tc.wantErr {
+			t.Errorf("Permits(%q) = %v, want %v", tc.host, got, !tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/awnumar/memguard"
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// checkClientCertificate checks the rule's sealed client certificate and key
+// against their sealed bindings for req. The certificate itself is presented
+// by the transport during the upstream handshake (see clientCertTransport),
+// and only for requests that passed this check.
+func (inj *Injector) checkClientCertificate(req *http.Request, rule config.Rule) *http.Response {
+	cc := rule.Inject.ClientCertificate
+	for _, name := range []string{cc.Cert, cc.Key} {
+		if err := inj.assertBindingAllowed(name, req.URL.Hostname(), req.Method); err != nil {
+			LogAuditEvent(req, rule.Name, name, false, true, err.Error())
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503,
+				"botlockbox: security block -- credential injection refused")
+		}
+	}
+	logInjection(req, rule.Name, []string{cc.Cert, cc.Key})
+	return nil
+}
+
+// clientCertTransport returns the round tripper for requests that a
+// client_certificate rule matched and checkClientCertificate accepted. Each
+// certificate gets its own transport, so a pooled connection that presented
+// it is never reused for a request that was not cleared to send it.
+func (inj *Injector) clientCertTransport(cc config.ClientCertificate) goproxy.RoundTripper {
+	key := cc.Cert + "\x00" + cc.Key
+	inj.certMu.Lock()
+	tr, ok := inj.certTransports[key]
+	if !ok {
+		tr = withClientCertificate(inj.upstream, func(host string) (*tls.Certificate, error) {
+			return inj.clientCertificate(cc, host)
+		})
+		if inj.certTransports == nil {
+			inj.certTransports = make(map[string]*http.Transport)
+		}
+		inj.certTransports[key] = tr
+	}
+	inj.certMu.Unlock()
+	return goproxy.RoundTripperFunc(func(req *http.Request, _ *goproxy.ProxyCtx) (*http.Response, error) {
+		return tr.RoundTrip(req)
+	})
+}
+
+// clientCertificate returns cc's certificate to present to host, or an empty
+// certificate, so the handshake proceeds without one, unless both the
+// certificate and key are sealed for host. The private key never leaves its
+// enclave except while signing the handshake.
+func (inj *Injector) clientCertificate(cc config.ClientCertificate, host string) (*tls.Certificate, error) {
+	inj.mu.RLock()
+	defer inj.mu.RUnlock()
+	if inj.assertHostAllowed(cc.Cert, host) != nil || inj.assertHostAllowed(cc.Key, host) != nil {
+		return &tls.Certificate{}, nil
+	}
+	buf, err := inj.openSecret(cc.Cert)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parseCertChainPEM(buf.Bytes())
+	buf.Destroy()
+	if err != nil {
+		return nil, fmt.Errorf("client certificate %q: %w", cc.Cert, err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("client certificate %q: %w", cc.Cert, err)
+	}
+	return &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  &sealedSigner{inj: inj, name: cc.Key, pub: leaf.PublicKey},
+		Leaf:        leaf,
+	}, nil
+}
+
+// parseCertChainPEM returns the DER bytes of every CERTIFICATE block in b.
+func parseCertChainPEM(b []byte) ([][]byte, error) {
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return chain, nil
+}
+
+// sealedSigner is a crypto.Signer whose private key stays sealed in the
+// injector's locked secrets; each Sign opens, parses and discards it.
+type sealedSigner struct {
+	inj  *Injector
+	name string
+	pub  crypto.PublicKey
+}
+
+func (s *sealedSigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *sealedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.inj.mu.RLock()
+	buf, err := s.inj.openSecret(s.name)
+	s.inj.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyPEM(buf.Bytes())
+	buf.Destroy()
+	if err != nil {
+		return nil, fmt.Errorf("client key %q: %w", s.name, err)
+	}
+	return key.Sign(rand, digest, opts)
+}
+
+// parsePrivateKeyPEM parses the first PRIVATE KEY block in keyPEM. The decoded
+// key bytes are scrambled once the key has been parsed.
+func parsePrivateKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, keyPEM = pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM private key found")
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			defer memguard.ScrambleBytes(block.Bytes)
+			return parsePrivateKey(block.Bytes)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentCodings returns the non-identity codings listed in h's
+// Content-Encoding, lower-cased, in the order they were applied.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	return codings
+}
+
+// unsupportedCoding returns the first coding decodeBody cannot undo, or "".
+func unsupportedCoding(codings []string) string {
+	for _, c := range codings {
+		switch c {
+		case "gzip", "x-gzip", "deflate", "br", "zstd":
+		default:
+			return c
+		}
+	}
+	return ""
+}
+
+// decodeBody wraps body so it yields the identity-encoded content, undoing
+// codings in reverse order of application. Callers must first check
+// unsupportedCoding. Decompression streams, so memory use stays bounded.
+func decodeBody(body io.ReadCloser, codings []string) (io.ReadCloser, error) {
+	r := io.Reader(body)
+	var closers []func()
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("decoding gzip response: %w", err)
+			}
+			r = zr
+		case "deflate":
+			r = newDeflateReader(r)
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, fmt.Errorf("decoding zstd response: %w", err)
+			}
+			closers = append(closers, zr.Close)
+			r = zr
+		default:
+			return nil, fmt.Errorf("unsupported Content-Encoding %q", codings[i])
+		}
+	}
+	return &decodedBody{Reader: r, body: body, closers: closers}, nil
+}
+
+// newDeflateReader accepts both the zlib-wrapped stream HTTP specifies for
+// "deflate" and the raw DEFLATE stream some servers send instead.
+func newDeflateReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if hdr, err := br.Peek(2); err == nil && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 && hdr[0]&0x0f == 8 {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+// decodedBody closes the decoders and the underlying response body together.
+type decodedBody struct {
+	io.Reader
+	body    io.Closer
+	closers []func()
+}
+
+func (d *decodedBody) Close() error {
+	for _, c := range d.closers {
+		c()
+	}
+	return d.body.Close()
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// injectCookies merges the rule's cookies into req's Cookie header, replacing
+// agent cookies of the same name. Under capture_set_cookies, a session value
+// captured from upstream for req's host is sent in place of the rendered
+// template; the template's secrets must still be sealed for req.
+func (inj *Injector) injectCookies(req *http.Request, rule config.Rule) *http.Response {
+	host := req.URL.Hostname()
+	var pairs, secretNames []string
+	for _, name := range slices.Sorted(maps.Keys(rule.Inject.Cookies)) {
+		t, names, resp := inj.checkTemplate(req, rule, rule.Inject.Cookies[name])
+		if resp != nil {
+			return resp
+		}
+		var value []byte
+		if rule.Inject.CaptureSetCookies {
+			value = inj.sessions.get(sessionKey(rule.Name, host, name))
+		}
+		if value == nil {
+			if value, resp = inj.execute(req, rule, t); resp != nil {
+				return resp
+			}
+		}
+		if !validCookieValue(value) {
+			memguard.ScrambleBytes(value)
+			// A ';' or ',' in the value would smuggle extra cookies into the header.
+			LogAuditEvent(req, rule.Name, names[0], false, true,
+				fmt.Sprintf("cookie %q: value is not a valid RFC 6265 cookie-value", name))
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: invalid cookie value")
+		}
+		pairs = append(pairs, name+"="+string(value))
+		memguard.ScrambleBytes(value)
+		for _, n := range names {
+			if !slices.Contains(secretNames, n) {
+				secretNames = append(secretNames, n)
+			}
+		}
+	}
+	req.Header.Set("Cookie", mergeCookies(req.Header.Values("Cookie"), rule.Inject.Cookies, pairs))
+	logInjection(req, rule.Name, secretNames)
+	return nil
+}
+
+// validCookieValue reports whether v is an RFC 6265 cookie-value: cookie-octets,
+// optionally wrapped in double quotes.
+func validCookieValue(v []byte) bool {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	for _, b := range v {
+		// cookie-octet = %x21 / %x23-2B / %x2D-3A / %x3C-5B / %x5D-7E
+		if b < 0x21 || b > 0x7e || b == '"' || b == ',' || b == ';' || b == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeCookies joins the cookie-pairs of the agent's Cookie header lines,
+// minus those named in replace, and pairs into a single Cookie header value.
+func mergeCookies(lines []string, replace map[string]string, pairs []string) string {
+	var merged []string
+	for _, line := range lines {
+		for _, pair := range strings.Split(line, ";") {
+			pair = strings.TrimSpace(pair)
+			name, _, _ := strings.Cut(pair, "=")
+			if _, ok := replace[strings.TrimSpace(name)]; ok || pair == "" {
+				continue
+			}
+			merged = append(merged, pair)
+		}
+	}
+	return strings.Join(append(merged, pairs...), "; ")
+}
+
+// captureSessionCookies is a response handler. For the matched rules that
+// set capture_set_cookies, it moves upstream Set-Cookie updates to their
+// injected cookies into inj.sessions and removes them from the response, so
+// the refreshed session never reaches the agent.
+func (inj *Injector) captureSessionCookies(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	rules, _ := ctx.UserData.([]*config.Rule)
+	captured := make(map[string][]*config.Rule)
+	for _, rule := range rules {
+		if rule.Inject.CaptureSetCookies {
+			for name := range rule.Inject.Cookies {
+				captured[name] = append(captured[name], rule)
+			}
+		}
+	}
+	lines := resp.Header.Values("Set-Cookie")
+	if len(captured) == 0 || len(lines) == 0 {
+		return resp
+	}
+
+	host := ctx.Req.URL.Hostname()
+	now := time.Now()
+	var kept []string
+	var names []string
+	for _, line := range lines {
+		c, err := http.ParseSetCookie(line)
+		if err != nil || captured[c.Name] == nil {
+			kept = append(kept, line)
+			continue
+		}
+		// Max-Age takes precedence over Expires (RFC 6265 §5.3).
+		var expiry time.Time
+		switch {
+		case c.MaxAge > 0:
+			expiry = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case c.MaxAge == 0 && !c.Expires.IsZero():
+			expiry = c.Expires
+		}
+		deleted := c.MaxAge < 0 || c.Value == "" || (!expiry.IsZero() && !now.Before(expiry))
+		for _, rule := range captured[c.Name] {
+			key := sessionKey(rule.Name, host, c.Name)
+			if deleted {
+				inj.sessions.delete(key)
+			} else {
+				inj.sessions.set(key, []byte(c.Value), expiry)
+			}
+		}
+		names = append(names, c.Name)
+	}
+	if len(names) == 0 {
+		return resp
+	}
+	resp.Header.Del("Set-Cookie")
+	for _, line := range kept {
+		resp.Header.Add("Set-Cookie", line)
+	}
+	ruleNames := make([]string, len(rules))
+	for i, rule := range rules {
+		ruleNames[i] = rule.Name
+	}
+	evt := newAuditEvent(ctx.Req, strings.Join(ruleNames, ","), "", false, false, "")
+	evt.CapturedCookies = names
+	evt.Log()
+	return resp
+}
+
+// sessionKey identifies a captured cookie: sessions are kept per rule and
+// upstream host.
+func sessionKey(ruleName, host, cookie string) string {
+	return ruleName + "\x00" + host + "\x00" + cookie
+}
+
+// sessionJar holds captured session cookie values in memguard enclaves. A nil
+// jar holds nothing.
+type sessionJar struct {
+	mu      sync.Mutex
+	cookies map[string]*sessionCookie
+}
+
+type sessionCookie struct {
+	enclave *memguard.Enclave
+	expiry  time.Time // zero for a cookie that lasts until the next reload
+}
+
+func newSessionJar() *sessionJar {
+	return &sessionJar{cookies: make(map[string]*sessionCookie)}
+}
+
+// get returns a copy of the unexpired value stored under key, or nil. The
+// caller must scramble it.
+func (j *sessionJar) get(key string) []byte {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c, ok := j.cookies[key]
+	if !ok {
+		return nil
+	}
+	if !c.expiry.IsZero() && !time.Now().Before(c.expiry) {
+		delete(j.cookies, key)
+		return nil
+	}
+	buf, err := c.enclave.Open()
+	if err != nil {
+		return nil
+	}
+	defer buf.Destroy()
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// set seals value, which it wipes, under key.
+func (j *sessionJar) set(key string, value []byte, expiry time.Time) {
+	if j == nil {
+		memguard.ScrambleBytes(value)
+		return
+	}
+	enclave := memguard.NewEnclave(value)
+	j.mu.Lock()
+	j.cookies[key] = &sessionCookie{enclave: enclave, expiry: expiry}
+	j.mu.Unlock()
+}
+
+func (j *sessionJar) delete(key string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	delete(j.cookies, key)
+	j.mu.Unlock()
+}
+
+// purge drops every captured cookie.
+func (j *sessionJar) purge() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.cookies = make(map[string]*sessionCookie)
+	j.mu.Unlock()
+}
@@ -9,13 +9,38 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"math/big"
+	"net"
+	"strings"
 	"time"
+
+	"github.com/awnumar/memguard"
 )
 
+// ephemeralCALifetime is how long a generated CA remains valid.
+const ephemeralCALifetime = 24 * time.Hour
+
 // GenerateEphemeralCA creates a fresh CA cert and key entirely in memory.
 // Never written to disk. 24h lifetime limits blast radius.
+// If permittedHosts is non-nil, the CA carries critical X.509 name constraints
+// so clients only accept leaf certificates it signs for those host patterns.
 // Returns the TLS certificate and the PEM-encoded public certificate (safe to share with clients).
-func GenerateEphemeralCA() (*tls.Certificate, []byte, error) {
+func GenerateEphemeralCA(permittedHosts []string) (*tls.Certificate, []byte, error) {
+	certPEM, keyPEM, err := generateCA("botlockbox ephemeral CA", ephemeralCALifetime, permittedHosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer memguard.ScrambleBytes(keyPEM)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cert, certPEM, nil
+}
+
+// generateCA creates a self-signed ECDSA P-256 CA valid for lifetime and
+// returns its certificate and private key as PEM. Callers own keyPEM and must
+// scramble it once it is no longer needed.
+func generateCA(organization string, lifetime time.Duration, permittedHosts []string) (certPEM, keyPEM []byte, err error) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
@@ -27,30 +52,63 @@ func GenerateEphemeralCA() (*tls.Certificate, []byte, error) {
 	template := &x509.Certificate{
 		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization: []string{"botlockbox ephemeral CA"},
+			Organization: []string{organization},
 			CommonName:   "botlockbox",
 		},
 		NotBefore:             time.Now().Add(-1 * time.Hour),
-		NotAfter:              time.Now().Add(24 * time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
 		IsCA:                  true,
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}
+	if permittedHosts != nil {
+		applyNameConstraints(template, permittedHosts)
+	}
 	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
 	if err != nil {
 		return nil, nil, err
 	}
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 	keyDER, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
 		return nil, nil, err
 	}
-	cert, err := tls.X509KeyPair(
-		certPEM,
-		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
-	)
-	if err != nil {
-		return nil, nil, err
+	defer memguard.ScrambleBytes(keyDER)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// applyNameConstraints limits template to signing for hostPatterns.
+// "*.example.com" permits subdomains of example.com only, an exact host permits
+// that host, and IP literals permit that single address. When no IP literal is
+// listed, every IP address is excluded so the CA cannot vouch for raw IPs.
+func applyNameConstraints(template *x509.Certificate, hostPatterns []string) {
+	template.PermittedDNSDomainsCritical = true
+	seen := make(map[string]struct{}, len(hostPatterns))
+	for _, pattern := range hostPatterns {
+		if _, ok := seen[pattern]; ok {
+			continue
+		}
+		seen[pattern] = struct{}{}
+
+		if ip := net.ParseIP(pattern); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			template.PermittedIPRanges = append(template.PermittedIPRanges,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			pattern = pattern[1:]
+		}
+		template.PermittedDNSDomains = append(template.PermittedDNSDomains, pattern)
 	}
-	return &cert, certPEM, nil
-}
\ No newline at end of file
+	if len(template.PermittedIPRanges) == 0 {
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)},
+		}
+	}
+}
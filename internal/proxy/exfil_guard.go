@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// maxGuardedBodyBytes is how much of a request body is buffered before the
+// exfiltration check, so that a leak in an ordinary-sized body is refused with
+// a clean 403. Anything beyond it is checked while it streams upstream.
+const maxGuardedBodyBytes = 4 << 20
+
+// errExfiltration aborts a streamed request body that carried a secret value.
+var errExfiltration = errors.New("botlockbox: request body contains a sealed secret value")
+
+// requestBody is the part of a request body that bufferBodyHead buffered,
+// for injections that sign or rewrite the body.
+type requestBody struct {
+	head     []byte
+	streamed bool // the body continues beyond head
+}
+
+// bufferBodyHead reads up to maxGuardedBodyBytes of req's body and restores
+// req.Body so that it yields the same bytes. It returns the buffered head and
+// whether the body continues beyond it.
+func bufferBodyHead(req *http.Request) (head []byte, streamed bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, false, nil
+	}
+	head, err = io.ReadAll(io.LimitReader(req.Body, maxGuardedBodyBytes+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, false, fmt.Errorf("reading request body: %w", err)
+	}
+	if len(head) <= maxGuardedBodyBytes {
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(head))
+		return head, false, nil
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+	return head, true, nil
+}
+
+// guardExfiltration refuses req if its URL, headers or buffered body head
+// contain the value (raw or encoded) of any loaded secret, other than the
+// secrets in sanctioned. If the body is streamed, req.Body is wrapped so the
+// whole of it is checked on its way upstream. Callers must hold inj.mu.
+func (inj *Injector) guardExfiltration(req *http.Request, ruleName string, sanctioned map[string]bool, head []byte, streamed bool) *http.Response {
+	if secret, form, where, ok := inj.findSecretInRequest(req, sanctioned, head); ok {
+		logExfiltration(req, ruleName, secret, form, where)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden,
+			"botlockbox: security block -- request contains a sealed secret value")
+	}
+	if streamed {
+		req.Body = &guardedBody{
+			inj:        inj,
+			req:        req,
+			ruleName:   ruleName,
+			sanctioned: sanctioned,
+			src:        req.Body,
+		}
+	}
+	return nil
+}
+
+// findSecretInRequest scans everything an agent controls in req except the
+// unbuffered body remainder. Callers must hold inj.mu.
+func (inj *Injector) findSecretInRequest(req *http.Request, sanctioned map[string]bool, head []byte) (secret, form, where string, ok bool) {
+	urlForms := [][]byte{[]byte(req.URL.String()), []byte(req.Host), []byte(req.URL.Path)}
+	if q, err := url.QueryUnescape(req.URL.RawQuery); err == nil {
+		urlForms = append(urlForms, []byte(q))
+	}
+	for _, b := range urlForms {
+		if secret, form, ok = inj.secretValues.find(b, sanctioned); ok {
+			return secret, form, "url", true
+		}
+	}
+	for name, values := range req.Header {
+		if secret, form, ok = inj.secretValues.find([]byte(name), sanctioned); ok {
+			return secret, form, "header " + name, true
+		}
+		for _, v := range values {
+			if secret, form, ok = inj.secretValues.find([]byte(v), sanctioned); ok {
+				return secret, form, "header " + name, true
+			}
+		}
+	}
+	if secret, form, ok = inj.secretValues.find(head, sanctioned); ok {
+		return secret, form, "body", true
+	}
+	return "", "", "", false
+}
+
+// sanctionedSecrets returns the secrets rule injects that the sealed envelope
+// allows for req; their values may legitimately appear in the request.
+// Callers must hold inj.mu.
+func (inj *Injector) sanctionedSecrets(rule *config.Rule, req *http.Request) map[string]bool {
+	if rule == nil {
+		return nil
+	}
+	sanctioned := make(map[string]bool)
+	names, _ := rule.Inject.SecretNames()
+	for _, name := range names {
+		if inj.assertBindingAllowed(name, req.URL.Hostname(), req.Method) == nil {
+			sanctioned[name] = true
+		}
+	}
+	return sanctioned
+}
+
+// logExfiltration records a blocked exfiltration attempt. The path is withheld
+// when the secret was found in the URL so the audit log never holds it.
+func logExfiltration(req *http.Request, ruleName, secret, form, where string) {
+	evt := newAuditEvent(req, ruleName, secret, false, true,
+		fmt.Sprintf("exfiltration: %s contains %s form of secret %q", where, form, secret))
+	evt.Severity = SeverityHigh
+	if where == "url" {
+		evt.Host = ""
+		evt.Path = ""
+	}
+	evt.Log()
+}
+
+// guardedBody checks a streamed request body for secret values, holding back
+// enough trailing bytes that a value split across reads is caught before any
+// of it is released upstream.
+type guardedBody struct {
+	inj        *Injector
+	req        *http.Request
+	ruleName   string
+	sanctioned map[string]bool
+	src        io.ReadCloser
+	pending    []byte
+	ready      int
+	err        error
+}
+
+func (g *guardedBody) Read(p []byte) (int, error) {
+	for g.ready == 0 && g.err == nil {
+		chunk := make([]byte, 32<<10)
+		n, err := g.src.Read(chunk)
+		g.pending = append(g.pending, chunk[:n]...)
+
+		g.inj.mu.RLock()
+		secret, form, found := g.inj.secretValues.find(g.pending, g.sanctioned)
+		keep := g.inj.secretValues.maxLen - 1
+		g.inj.mu.RUnlock()
+
+		if found {
+			logExfiltration(g.req, g.ruleName, secret, form, "body")
+			g.pending = nil
+			g.err = errExfiltration
+			break
+		}
+		if err != nil {
+			g.ready = len(g.pending)
+			g.err = err
+			break
+		}
+		if keep < 0 {
+			keep = 0
+		}
+		if len(g.pending) > keep {
+			g.ready = len(g.pending) - keep
+		}
+	}
+	if g.ready == 0 {
+		return 0, g.err
+	}
+	n := copy(p, g.pending[:g.ready])
+	g.pending = g.pending[n:]
+	g.ready -= n
+	return n, nil
+}
+
+func (g *guardedBody) Close() error {
+	return g.src.Close()
+}
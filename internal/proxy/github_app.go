@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// githubAppJWTLifetime is how long each app JWT is valid; GitHub allows ten
+// minutes at most.
+const githubAppJWTLifetime = 9 * time.Minute
+
+// gitHubAppToken describes the GitHub App installation token minted with the
+// rule's sealed app private key. REST API requests get Authorization: Bearer;
+// anything else, such as git over HTTPS to github.com, gets the token as the
+// Basic auth password of the x-access-token user.
+func (inj *Injector) gitHubAppToken(req *http.Request, rule config.Rule) mintedToken {
+	cfg := rule.Inject.GitHubApp
+	api := cfg.API()
+
+	perms := make([]string, 0, len(cfg.Permissions))
+	for name, level := range cfg.Permissions {
+		perms = append(perms, name+"="+level)
+	}
+	sort.Strings(perms)
+	key := strings.Join([]string{"github_app", api.String(), cfg.AppID, strconv.FormatInt(cfg.InstallationID, 10),
+		cfg.PrivateKey, strings.Join(cfg.Repositories, ","), strings.Join(perms, ",")}, "\x00")
+
+	return mintedToken{
+		kind:      "github_app",
+		secret:    cfg.PrivateKey,
+		tokenHost: api.Hostname(),
+		key:       key,
+		mint: func(secret *memguard.Enclave) ([]byte, time.Duration, error) {
+			return inj.mintGitHubAppToken(cfg, secret)
+		},
+		set: func(token []byte) {
+			if req.URL.Hostname() == api.Hostname() && strings.HasPrefix(req.URL.Path, api.Path) {
+				req.Header.Set("Authorization", "Bearer "+string(token))
+				return
+			}
+			pair := append([]byte("x-access-token:"), token...)
+			enc := make([]byte, base64.StdEncoding.EncodedLen(len(pair)))
+			base64.StdEncoding.Encode(enc, pair)
+			req.Header.Set("Authorization", "Basic "+string(enc))
+			memguard.ScrambleBytes(pair)
+			memguard.ScrambleBytes(enc)
+		},
+	}
+}
+
+// mintGitHubAppToken signs an app JWT and exchanges it for an installation
+// access token, narrowed to cfg's repositories and permissions if set.
+func (inj *Injector) mintGitHubAppToken(cfg *config.GitHubApp, secret *memguard.Enclave) ([]byte, time.Duration, error) {
+	keyPEM, err := openEnclave(cfg.PrivateKey, secret)
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now()
+	jwt, err := signJWT(keyPEM.Bytes(), "", map[string]any{
+		// Backdated to allow for clock drift, as GitHub recommends.
+		"iat": now.Add(-60 * time.Second).Unix(),
+		"exp": now.Add(githubAppJWTLifetime).Unix(),
+		"iss": cfg.AppID,
+	})
+	keyPEM.Destroy()
+	if err != nil {
+		return nil, 0, fmt.Errorf("github_app private key %q: %w", cfg.PrivateKey, err)
+	}
+
+	var body io.Reader = http.NoBody
+	if len(cfg.Repositories) > 0 || len(cfg.Permissions) > 0 {
+		scope, err := json.Marshal(struct {
+			Repositories []string          `json:"repositories,omitempty"`
+			Permissions  map[string]string `json:"permissions,omitempty"`
+		}{cfg.Repositories, cfg.Permissions})
+		if err != nil {
+			return nil, 0, err
+		}
+		body = bytes.NewReader(scope)
+	}
+	endpoint := fmt.Sprintf("%s/app/installations/%d/access_tokens", cfg.API(), cfg.InstallationID)
+	req, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != http.NoBody {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := inj.tokens.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseBytes))
+	defer memguard.ScrambleBytes(raw)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading installation token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(raw, &e) == nil && e.Message != "" {
+			return nil, 0, fmt.Errorf("GitHub returned %d (%s)", resp.StatusCode, e.Message)
+		}
+		return nil, 0, fmt.Errorf("GitHub returned %d", resp.StatusCode)
+	}
+
+	var tr struct {
+		Token     json.RawMessage `json:"token"`
+		ExpiresAt time.Time       `json:"expires_at"`
+	}
+	if err := json.Unmarshal(raw, &tr); err != nil {
+		return nil, 0, fmt.Errorf("decoding installation token response: %w", err)
+	}
+	token, err := rawJSONString(tr.Token)
+	if err != nil || len(token) == 0 {
+		return nil, 0, fmt.Errorf("installation token response has no token")
+	}
+	var lifetime time.Duration
+	if !tr.ExpiresAt.IsZero() {
+		lifetime = time.Until(tr.ExpiresAt)
+	}
+	return token, lifetime, nil
+}
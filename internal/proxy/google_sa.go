@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// googleAssertionLifetime is the lifetime of each signed JWT assertion;
+// Google accepts at most one hour.
+const googleAssertionLifetime = time.Hour
+
+// googleToken describes the access token minted from the rule's sealed
+// service-account key, injected as Authorization: Bearer on req.
+func (inj *Injector) googleToken(req *http.Request, rule config.Rule) mintedToken {
+	cfg := rule.Inject.GoogleServiceAccount
+	key := strings.Join([]string{"google_service_account", cfg.Endpoint(), cfg.Key, cfg.Subject, strings.Join(cfg.Scopes, " ")}, "\x00")
+	return mintedToken{
+		kind:      "google_service_account",
+		secret:    cfg.Key,
+		tokenHost: cfg.TokenHost(),
+		key:       key,
+		mint: func(secret *memguard.Enclave) ([]byte, time.Duration, error) {
+			return inj.mintGoogleToken(cfg, secret)
+		},
+		set: func(token []byte) {
+			req.Header.Set("Authorization", "Bearer "+string(token))
+		},
+	}
+}
+
+// mintGoogleToken signs a JWT assertion with the service account's private
+// key and exchanges it at the token endpoint (RFC 7523).
+func (inj *Injector) mintGoogleToken(cfg *config.GoogleServiceAccount, secret *memguard.Enclave) ([]byte, time.Duration, error) {
+	buf, err := openEnclave(cfg.Key, secret)
+	if err != nil {
+		return nil, 0, err
+	}
+	var sa struct {
+		Type         string          `json:"type"`
+		ClientEmail  string          `json:"client_email"`
+		PrivateKeyID string          `json:"private_key_id"`
+		PrivateKey   json.RawMessage `json:"private_key"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &sa)
+	buf.Destroy()
+	defer memguard.ScrambleBytes(sa.PrivateKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("service account key %q is not JSON", cfg.Key)
+	}
+	if sa.Type != "service_account" || sa.ClientEmail == "" {
+		return nil, 0, fmt.Errorf("secret %q is not a service account key", cfg.Key)
+	}
+	keyPEM, err := rawJSONString(sa.PrivateKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("service account key %q: private_key: %w", cfg.Key, err)
+	}
+	defer memguard.ScrambleBytes(keyPEM)
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   sa.ClientEmail,
+		"scope": strings.Join(cfg.Scopes, " "),
+		"aud":   cfg.Endpoint(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(googleAssertionLifetime).Unix(),
+	}
+	if cfg.Subject != "" {
+		claims["sub"] = cfg.Subject
+	}
+	assertion, err := signJWT(keyPEM, sa.PrivateKeyID, claims)
+	if err != nil {
+		return nil, 0, fmt.Errorf("service account key %q: %w", cfg.Key, err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}.Encode()
+	req, err := http.NewRequest(http.MethodPost, cfg.Endpoint(), strings.NewReader(form))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return doTokenRequest(inj.tokens.client, req)
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// signHMAC signs req with the rule's sealed HMAC key, after checking the key
+// against its sealed binding. A body that is part of the signature must have
+// been buffered whole. On failure it logs a blocked audit event and returns
+// the response to send instead.
+func (inj *Injector) signHMAC(req *http.Request, rule config.Rule, body *requestBody) *http.Response {
+	cfg := rule.Inject.HMAC
+	if err := inj.assertBindingAllowed(cfg.Key, req.URL.Hostname(), req.Method); err != nil {
+		LogAuditEvent(req, rule.Name, cfg.Key, false, true, err.Error())
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, 503,
+			"botlockbox: security block -- credential injection refused")
+	}
+	if cfg.SignsBody() && body.streamed {
+		reason := fmt.Sprintf("request body larger than %d bytes cannot be signed", maxGuardedBodyBytes)
+		LogAuditEvent(req, rule.Name, cfg.Key, false, true, "hmac: "+reason)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusRequestEntityTooLarge,
+			"botlockbox: "+reason)
+	}
+
+	buf, err := inj.openSecret(cfg.Key)
+	if err != nil {
+		LogAuditEvent(req, rule.Name, cfg.Key, false, true, err.Error())
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: secret unavailable")
+	}
+	key, err := decodeHMACKey(buf.Bytes(), cfg.KeyEncoding)
+	buf.Destroy()
+	if err != nil {
+		LogAuditEvent(req, rule.Name, cfg.Key, false, true, "hmac: "+err.Error())
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: secret unavailable")
+	}
+	defer memguard.ScrambleBytes(key)
+
+	timestamp := formatHMACTimestamp(time.Now(), cfg.TimestampFormat)
+	if cfg.TimestampHeader != "" {
+		req.Header.Set(cfg.TimestampHeader, timestamp)
+	}
+	var newHash func() hash.Hash = sha256.New
+	if cfg.Hash == "sha512" {
+		newHash = sha512.New
+	}
+	mac := hmac.New(newHash, key)
+	mac.Write(hmacStringToSign(req, cfg, body.head, timestamp))
+	sum := mac.Sum(nil)
+
+	var sig string
+	switch cfg.Encoding {
+	case "base64":
+		sig = base64.StdEncoding.EncodeToString(sum)
+	case "base64url":
+		sig = base64.RawURLEncoding.EncodeToString(sum)
+	default:
+		sig = hex.EncodeToString(sum)
+	}
+	req.Header.Set(cfg.SignatureHeader, cfg.SignaturePrefix+sig)
+
+	logInjection(req, rule.Name, []string{cfg.Key})
+	return nil
+}
+
+// hmacStringToSign joins cfg's components of req with cfg's separator.
+func hmacStringToSign(req *http.Request, cfg *config.HMAC, body []byte, timestamp string) []byte {
+	var b []byte
+	for i, c := range cfg.Components {
+		if i > 0 {
+			b = append(b, cfg.Sep()...)
+		}
+		switch c {
+		case config.HMACMethod:
+			b = append(b, strings.ToUpper(req.Method)...)
+		case config.HMACHost:
+			b = append(b, req.URL.Hostname()...)
+		case config.HMACPath:
+			b = append(b, req.URL.EscapedPath()...)
+		case config.HMACQuery:
+			b = append(b, req.URL.RawQuery...)
+		case config.HMACPathQuery:
+			b = append(b, req.URL.EscapedPath()...)
+			if req.URL.RawQuery != "" {
+				b = append(append(b, '?'), req.URL.RawQuery...)
+			}
+		case config.HMACTimestamp:
+			b = append(b, timestamp...)
+		case config.HMACBody:
+			b = append(b, body...)
+		case config.HMACBodySHA256:
+			sum := sha256.Sum256(body)
+			b = hex.AppendEncode(b, sum[:])
+		default:
+			if name, ok := strings.CutPrefix(c, "header:"); ok {
+				b = append(b, req.Header.Get(name)...)
+			} else {
+				b = append(b, strings.TrimPrefix(c, "literal:")...)
+			}
+		}
+	}
+	return b
+}
+
+// decodeHMACKey returns a copy of the sealed key, decoded per encoding.
+// The caller must scramble it.
+func decodeHMACKey(sealed []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "base64":
+		key := make([]byte, base64.StdEncoding.DecodedLen(len(sealed)))
+		n, err := base64.StdEncoding.Decode(key, sealed)
+		if err != nil {
+			memguard.ScrambleBytes(key)
+			return nil, fmt.Errorf("key is not valid base64")
+		}
+		return key[:n], nil
+	case "hex":
+		key := make([]byte, hex.DecodedLen(len(sealed)))
+		if _, err := hex.Decode(key, sealed); err != nil {
+			memguard.ScrambleBytes(key)
+			return nil, fmt.Errorf("key is not valid hex")
+		}
+		return key, nil
+	}
+	return append([]byte(nil), sealed...), nil
+}
+
+func formatHMACTimestamp(t time.Time, format string) string {
+	switch format {
+	case "unix_ms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case "rfc3339":
+		return t.UTC().Format(time.RFC3339)
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
@@ -1,112 +1,392 @@
 package proxy
 
 import (
-	"bytes"
 	"fmt"
+	"net"
 	"net/http"
-	"regexp"
 	"strings"
 	"sync"
-	"text/template"
 
 	"github.com/awnumar/memguard"
 	"github.com/elazarl/goproxy"
 	"github.com/trodemaster/botlockbox/internal/config"
 	"github.com/trodemaster/botlockbox/internal/matcher"
 	"github.com/trodemaster/botlockbox/internal/secrets"
+	"github.com/trodemaster/botlockbox/internal/tmpl"
 )
 
-var secretNameRe = regexp.MustCompile(`\{\{secrets\.(\w+)\}\}`)
+// defaultStripHeaders are credential-bearing headers always removed from a
+// matched request before injection, so an agent cannot smuggle its own (or a
+// spoofed) credential alongside the injected one.
+var defaultStripHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
 
 // Injector holds the rules, sealed envelope, and locked secrets.
 type Injector struct {
 	mu            sync.RWMutex
 	rules         []config.Rule
+	order         []ruleEntry
+	orderOnce     sync.Once
 	envelope      *secrets.SealedEnvelope
 	lockedSecrets map[string]*memguard.Enclave
 
-	// CACertPEM is the PEM-encoded public certificate of the ephemeral MITM CA.
-	// Safe to write to disk or share with clients that need to trust the proxy.
-	CACertPEM []byte
+	// secretValues matches the loaded secret values in outbound traffic.
+	secretValues *secretValues
+
+	// egress and egressAllowlist decide which hosts requests may reach.
+	egress          string
+	egressAllowlist []string
+
+	// mitmHosts and passthroughHosts override the CONNECT decision made from
+	// rule hosts; mitmAction is returned for every intercepted CONNECT.
+	mitmHosts        []string
+	passthroughHosts []string
+	mitmAction       *goproxy.ConnectAction
+
+	// unknownEncoding is the config.UnknownEncoding policy for responses the
+	// scrubber cannot decode.
+	unknownEncoding string
+
+	// scrubPatterns are the global scrub patterns from the config.
+	scrubPatterns []config.ScrubPattern
+
+	// tokens caches access tokens minted from sealed credentials.
+	tokens *tokenCache
+
+	// sessions holds session cookies captured from upstream Set-Cookie headers.
+	sessions *sessionJar
+
+	// upstream is the transport for requests that present no client
+	// certificate; certTransports are its per-certificate copies.
+	upstream       *http.Transport
+	certMu         sync.Mutex
+	certTransports map[string]*http.Transport
+
+	// CA is the MITM CA manager. Its BundlePEM is safe to write to disk or
+	// share with clients that need to trust the proxy.
+	CA *CAManager
 }
 
 // Handle is the goproxy request handler.
+// Rules are tried in resolved precedence order (see resolveRuleOrder); the
+// first match is applied, along with later matches while rules set continue.
+// Requests carrying the value of a loaded secret are refused unless the
+// matched rule injects that secret and its sealed allowlist covers the host.
 func (inj *Injector) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	// The body is read before taking the lock so a slow upload cannot stall a reload.
+	head, streamed, err := bufferBodyHead(req)
+	if err != nil {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest,
+			"botlockbox: "+err.Error())
+	}
+
+	rules, pending, resp := inj.screen(req, ctx, head, streamed)
+	if resp != nil || len(rules) == 0 {
+		return req, resp
+	}
+
+	// Tokens are minted between the locked sections, so a slow token endpoint
+	// cannot stall a reload and every request behind it.
+	tokens := inj.mintTokens(pending)
+	defer func() {
+		for _, r := range tokens {
+			if r.token != nil {
+				r.token.Destroy()
+			}
+		}
+	}()
+
 	inj.mu.RLock()
 	defer inj.mu.RUnlock()
-	for _, rule := range inj.rules {
-		if matcher.Matches(req, rule.Match) {
-			if resp := inj.apply(req, rule); resp != nil {
-				return req, resp
-			}
-			return req, nil
+	body := &requestBody{head: head, streamed: streamed}
+	var cc *config.ClientCertificate
+	for _, rule := range rules {
+		if resp := inj.apply(req, *rule, body, tokens); resp != nil {
+			return req, resp
+		}
+		if cc == nil {
+			cc = rule.Inject.ClientCertificate
 		}
 	}
+	if cc != nil && ctx != nil {
+		// Only requests cleared by checkClientCertificate present it.
+		ctx.RoundTripper = inj.clientCertTransport(*cc)
+	}
 	return req, nil
 }
 
-func (inj *Injector) apply(req *http.Request, rule config.Rule) *http.Response {
-	host := req.URL.Hostname()
+// screen matches req against the rules and runs the checks that come before
+// any injection: the exfiltration guard, the egress policy and header
+// stripping. It returns the matched rules and the tokens they need minted,
+// or the response to send instead.
+func (inj *Injector) screen(req *http.Request, ctx *goproxy.ProxyCtx, head []byte, streamed bool) ([]*config.Rule, []pendingMint, *http.Response) {
+	inj.mu.RLock()
+	defer inj.mu.RUnlock()
+	rules := inj.matchingRules(req)
+	if len(rules) == 0 {
+		if resp := inj.guardExfiltration(req, "", nil, head, streamed); resp != nil {
+			return nil, nil, resp
+		}
+		if !inj.egressAllowed(req.URL.Hostname()) {
+			LogAuditEvent(req, "", "", false, true, "egress denied: host matches no sealed rule host or egress_allowlist entry")
+			return nil, nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden,
+				"botlockbox: egress denied")
+		}
+		return nil, nil, nil
+	}
+	if ctx != nil {
+		// The response scrubber applies the rules' scrub patterns.
+		ctx.UserData = rules
+	}
+	names := make([]string, len(rules))
+	sanctioned := make(map[string]bool)
+	var strip []string
+	mergeCookies := false
+	for i, rule := range rules {
+		names[i] = rule.Name
+		for name := range inj.sanctionedSecrets(rule, req) {
+			sanctioned[name] = true
+		}
+		strip = append(strip, rule.Inject.StripHeaders...)
+		mergeCookies = mergeCookies || len(rule.Inject.Cookies) > 0
+	}
+	if resp := inj.guardExfiltration(req, strings.Join(names, ","), sanctioned, head, streamed); resp != nil {
+		return nil, nil, resp
+	}
+	if !inj.egressAllowed(req.URL.Hostname()) {
+		LogAuditEvent(req, strings.Join(names, ","), "", false, true, "egress denied: host was not committed at seal time")
+		return nil, nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden,
+			"botlockbox: egress denied")
+	}
+	// Strip once, so a continuing rule cannot remove what an earlier one injected.
+	if stripped := stripHeaders(req, strip, mergeCookies); len(stripped) > 0 {
+		// Audited here, as a rule may strip without injecting anything.
+		evt := newAuditEvent(req, strings.Join(names, ","), "", false, false, "")
+		evt.StrippedHeaders = stripped
+		evt.Log()
+	}
+	return rules, inj.pendingMints(req, rules), nil
+}
 
-	for header, tmplStr := range rule.Inject.Headers {
-		secretName, err := extractSingleSecretName(tmplStr)
-		if err != nil {
-			LogAuditEvent(req, rule.Name, "unknown", false, true, err.Error())
-			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: template error")
-		}
-		if err := inj.assertHostAllowed(secretName, host); err != nil {
-			LogAuditEvent(req, rule.Name, secretName, false, true, err.Error())
-			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503,
-				"botlockbox: security block -- credential injection refused")
+// egressAllowed reports whether a request to host may leave the proxy. In
+// deny mode the host must match an egress_allowlist entry, or a rule host
+// pattern that the sealed envelope also covers: rules that reference no
+// secret are not sealed, so their hosts alone cannot widen the policy.
+// Callers must hold inj.mu.
+func (inj *Injector) egressAllowed(host string) bool {
+	if inj.egress != config.EgressDeny {
+		return true
+	}
+	if matcher.HostMatchesAny(host, inj.egressAllowlist) {
+		return true
+	}
+	return inj.ruleHostMatches(host) && inj.sealedHostMatches(host)
+}
+
+// ruleHostMatches reports whether any rule could apply to host.
+// Callers must hold inj.mu.
+func (inj *Injector) ruleHostMatches(host string) bool {
+	for _, rule := range inj.rules {
+		if matcher.HostMatchesAny(host, rule.Match.Hosts) {
+			return true
 		}
-		value, err := inj.getSecret(secretName)
-		if err != nil {
-			LogAuditEvent(req, rule.Name, secretName, false, true, err.Error())
-			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: secret unavailable")
+	}
+	return false
+}
+
+// sealedHostMatches reports whether host matches a host pattern committed at
+// seal time. Callers must hold inj.mu.
+func (inj *Injector) sealedHostMatches(host string) bool {
+	for _, hosts := range inj.envelope.AllowedHosts {
+		if matcher.HostMatchesAny(host, hosts) {
+			return true
 		}
-		rendered, renderErr := renderTemplate(tmplStr, secretName, value)
-		memguard.ScrambleBytes([]byte(value))
-		if renderErr != nil {
-			LogAuditEvent(req, rule.Name, secretName, false, true, renderErr.Error())
-			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: template render error")
+	}
+	return matcher.HostMatchesAny(host, inj.envelope.EgressAllowlist)
+}
+
+// HandleConnect is the goproxy CONNECT handler. Only hosts a rule could inject
+// into (or listed in mitm_hosts) are intercepted with the MITM CA; every other
+// host gets a plain tunnel so certificate-pinning clients keep working and
+// botlockbox decrypts as little traffic as possible. passthrough_hosts always
+// tunnels, as do hosts outside a name-constrained CA. In egress deny mode,
+// tunnels to non-allowlisted hosts are refused.
+func (inj *Injector) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	hostname := hostnameOf(host)
+
+	inj.mu.RLock()
+	defer inj.mu.RUnlock()
+
+	if secret, form, ok := inj.secretValues.find([]byte(hostname), nil); ok {
+		logExfiltration(ctx.Req, "", secret, form, "url")
+		ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden,
+			"botlockbox: security block -- request contains a sealed secret value")
+		return goproxy.RejectConnect, host
+	}
+	if !inj.egressAllowed(hostname) {
+		LogAuditEvent(ctx.Req, "", "", false, true, "egress denied: CONNECT host matches no sealed rule host or egress_allowlist entry")
+		ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden,
+			"botlockbox: egress denied")
+		return goproxy.RejectConnect, host
+	}
+	if !matcher.HostMatchesAny(hostname, inj.passthroughHosts) && inj.CA.Permits(hostname) &&
+		(inj.ruleHostMatches(hostname) || matcher.HostMatchesAny(hostname, inj.mitmHosts)) {
+		return inj.mitmAction, host
+	}
+	return goproxy.OkConnect, host
+}
+
+// apply injects rule's credentials into req, taking minted tokens from
+// tokens. Signing comes last, so that it covers everything the rule injected.
+func (inj *Injector) apply(req *http.Request, rule config.Rule, body *requestBody, tokens map[string]*mintResult) *http.Response {
+	for header, tmplStr := range rule.Inject.Headers {
+		rendered, names, resp := inj.render(req, rule, tmplStr)
+		if resp != nil {
+			return resp
 		}
 		req.Header.Set(header, rendered)
-		LogAuditEvent(req, rule.Name, secretName, true, false, "")
+		logInjection(req, rule.Name, names)
 	}
 
 	if len(rule.Inject.QueryParams) > 0 {
 		q := req.URL.Query()
 		for param, tmplStr := range rule.Inject.QueryParams {
-			secretName, err := extractSingleSecretName(tmplStr)
-			if err != nil {
-				LogAuditEvent(req, rule.Name, "unknown", false, true, err.Error())
-				return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: template error")
-			}
-			if err := inj.assertHostAllowed(secretName, host); err != nil {
-				LogAuditEvent(req, rule.Name, secretName, false, true, err.Error())
-				return goproxy.NewResponse(req, goproxy.ContentTypeText, 503,
-					"botlockbox: security block -- credential injection refused")
-			}
-			value, err := inj.getSecret(secretName)
-			if err != nil {
-				LogAuditEvent(req, rule.Name, secretName, false, true, err.Error())
-				return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: secret unavailable")
-			}
-			rendered, renderErr := renderTemplate(tmplStr, secretName, value)
-			memguard.ScrambleBytes([]byte(value))
-			if renderErr != nil {
-				LogAuditEvent(req, rule.Name, secretName, false, true, renderErr.Error())
-				return goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: template render error")
+			rendered, names, resp := inj.render(req, rule, tmplStr)
+			if resp != nil {
+				return resp
 			}
 			q.Set(param, rendered)
-			LogAuditEvent(req, rule.Name, secretName, true, false, "")
+			logInjection(req, rule.Name, names)
 		}
 		req.URL.RawQuery = q.Encode()
 	}
 
+	if len(rule.Inject.Cookies) > 0 {
+		if resp := inj.injectCookies(req, rule); resp != nil {
+			return resp
+		}
+	}
+	if rule.Inject.Body != nil {
+		if resp := inj.injectBody(req, rule, body); resp != nil {
+			return resp
+		}
+	}
+	if rule.Inject.ClientCertificate != nil {
+		if resp := inj.checkClientCertificate(req, rule); resp != nil {
+			return resp
+		}
+	}
+	for _, t := range inj.ruleTokens(req, rule) {
+		if resp := inj.injectMintedToken(req, rule, t, tokens); resp != nil {
+			return resp
+		}
+	}
+	if rule.Inject.HMAC != nil {
+		if resp := inj.signHMAC(req, rule, body); resp != nil {
+			return resp
+		}
+	}
+	if rule.Inject.AWSSigV4 != nil {
+		return inj.signAWSv4(req, rule, body)
+	}
 	return nil
 }
 
+// render parses tmplStr and renders it, after checking each secret it
+// references against its own sealed binding for req. On failure it logs a
+// blocked audit event and returns the response to send instead.
+func (inj *Injector) render(req *http.Request, rule config.Rule, tmplStr string) (string, []string, *http.Response) {
+	t, names, resp := inj.checkTemplate(req, rule, tmplStr)
+	if resp != nil {
+		return "", nil, resp
+	}
+	out, resp := inj.execute(req, rule, t)
+	if resp != nil {
+		return "", nil, resp
+	}
+	rendered := string(out)
+	memguard.ScrambleBytes(out)
+	return rendered, names, nil
+}
+
+// checkTemplate parses tmplStr and checks each secret it references against
+// its own sealed binding for req, returning the template and those names.
+// On failure it logs a blocked audit event and returns the response to send
+// instead.
+func (inj *Injector) checkTemplate(req *http.Request, rule config.Rule, tmplStr string) (*tmpl.Template, []string, *http.Response) {
+	t, err := tmpl.Parse(tmplStr)
+	if err != nil {
+		LogAuditEvent(req, rule.Name, "unknown", false, true,
+			fmt.Sprintf("parsing template %q: %v", tmplStr, err))
+		return nil, nil, goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: template error")
+	}
+	names := t.SecretNames()
+	if len(names) == 0 {
+		LogAuditEvent(req, rule.Name, "unknown", false, true,
+			fmt.Sprintf("no {{secrets.NAME}} reference found in template %q", tmplStr))
+		return nil, nil, goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: template error")
+	}
+	host := req.URL.Hostname()
+	for _, name := range names {
+		if err := inj.assertBindingAllowed(name, host, req.Method); err != nil {
+			LogAuditEvent(req, rule.Name, name, false, true, err.Error())
+			return nil, nil, goproxy.NewResponse(req, goproxy.ContentTypeText, 503,
+				"botlockbox: security block -- credential injection refused")
+		}
+	}
+	return t, names, nil
+}
+
+// execute renders a template checkTemplate has accepted. The caller must
+// scramble the result.
+func (inj *Injector) execute(req *http.Request, rule config.Rule, t *tmpl.Template) ([]byte, *http.Response) {
+	var current string
+	out, err := t.Execute(func(name string) (*memguard.LockedBuffer, error) {
+		current = name
+		return inj.openSecret(name)
+	})
+	if err != nil {
+		LogAuditEvent(req, rule.Name, current, false, true, err.Error())
+		return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, 503, "botlockbox: secret unavailable")
+	}
+	return out, nil
+}
+
+// logInjection records a successful injection of the named secrets.
+func logInjection(req *http.Request, ruleName string, names []string) {
+	injectionEvent(req, ruleName, names).Log()
+}
+
+// injectionEvent builds the audit event for a successful injection of the
+// named secrets.
+func injectionEvent(req *http.Request, ruleName string, names []string) AuditEvent {
+	evt := newAuditEvent(req, ruleName, names[0], true, false, "")
+	if len(names) > 1 {
+		evt.SecretNames = names
+	}
+	return evt
+}
+
+// stripHeaders removes the default credential headers plus extra from req and
+// returns the canonical names of the headers that were actually present.
+// With mergeCookies, the agent's Cookie header is kept (unless extra names it)
+// so that injected cookies can be merged into it.
+func stripHeaders(req *http.Request, extra []string, mergeCookies bool) []string {
+	var stripped []string
+	for i, list := range [][]string{defaultStripHeaders, extra} {
+		for _, name := range list {
+			name = http.CanonicalHeaderKey(name)
+			if i == 0 && mergeCookies && name == "Cookie" {
+				continue
+			}
+			if _, ok := req.Header[name]; ok {
+				req.Header.Del(name)
+				stripped = append(stripped, name)
+			}
+		}
+	}
+	return stripped
+}
+
 func (inj *Injector) assertHostAllowed(secretName, host string) error {
 	allowedHosts, ok := inj.envelope.AllowedHosts[secretName]
 	if !ok {
@@ -121,47 +401,87 @@ func (inj *Injector) assertHostAllowed(secretName, host string) error {
 		secretName, host, allowedHosts)
 }
 
-func (inj *Injector) getSecret(name string) (string, error) {
-	enc, ok := inj.lockedSecrets[name]
-	if !ok {
-		return "", fmt.Errorf("secret %q not found in locked secrets", name)
+// assertMethodAllowed checks method against the methods the sealed envelope
+// binds secretName to, if it restricts them.
+func (inj *Injector) assertMethodAllowed(secretName, method string) error {
+	methods, restricted := inj.envelope.AllowedMethods[secretName]
+	if !restricted || matcher.MethodMatches(method, methods) {
+		return nil
 	}
-	buf, err := enc.Open()
+	return fmt.Errorf("secret %q may not be sent with method %s -- sealed methods: %v",
+		secretName, method, methods)
+}
+
+// assertBindingAllowed checks both halves of the sealed binding for secretName.
+func (inj *Injector) assertBindingAllowed(secretName, host, method string) error {
+	if err := inj.assertHostAllowed(secretName, host); err != nil {
+		return err
+	}
+	return inj.assertMethodAllowed(secretName, method)
+}
+
+func (inj *Injector) getSecret(name string) (string, error) {
+	buf, err := inj.openSecret(name)
 	if err != nil {
-		return "", fmt.Errorf("opening memguard enclave for %q: %w", name, err)
+		return "", err
 	}
 	val := string(buf.Bytes())
 	buf.Destroy()
 	return val, nil
 }
 
-func extractSingleSecretName(tmpl string) (string, error) {
-	matches := secretNameRe.FindAllStringSubmatch(tmpl, -1)
-	if len(matches) == 0 {
-		return "", fmt.Errorf("no {{secrets.NAME}} reference found in template %q", tmpl)
+// openSecret opens the enclave holding name. The caller must destroy the
+// returned buffer.
+func (inj *Injector) openSecret(name string) (*memguard.LockedBuffer, error) {
+	enc, ok := inj.lockedSecrets[name]
+	if !ok {
+		return nil, fmt.Errorf("secret %q not found in locked secrets", name)
 	}
-	return matches[0][1], nil
+	return openEnclave(name, enc)
 }
 
-func renderTemplate(tmplStr, secretName, secretValue string) (string, error) {
-	result := strings.ReplaceAll(tmplStr, "{{secrets."+secretName+"}}", secretValue)
-	if strings.Contains(result, "{{") {
-		t, err := template.New(" ").Parse(result)
-		if err != nil {
-			return "", err
-		}
-		var buf bytes.Buffer
-		if err := t.Execute(&buf, nil); err != nil {
-			return "", err
+// openEnclave opens enc, which holds the secret name. The caller must destroy
+// the returned buffer.
+func openEnclave(name string, enc *memguard.Enclave) (*memguard.LockedBuffer, error) {
+	buf, err := enc.Open()
+	if err != nil {
+		return nil, fmt.Errorf("opening memguard enclave for %q: %w", name, err)
+	}
+	return buf, nil
+}
+
+// prewarmHosts returns the exact (non-glob) rule hosts that HandleConnect
+// would intercept, i.e. the hosts worth signing leaf certificates for ahead of time.
+func (inj *Injector) prewarmHosts() []string {
+	inj.mu.RLock()
+	defer inj.mu.RUnlock()
+	seen := make(map[string]struct{})
+	var hosts []string
+	for _, rule := range inj.rules {
+		for _, h := range rule.Match.Hosts {
+			if strings.Contains(h, "*") || matcher.HostMatchesAny(h, inj.passthroughHosts) || !inj.CA.Permits(h) {
+				continue
+			}
+			if _, ok := seen[h]; !ok {
+				seen[h] = struct{}{}
+				hosts = append(hosts, h)
+			}
 		}
-		return buf.String(), nil
 	}
-	return result, nil
+	return hosts
+}
+
+// hostnameOf strips an optional port from a CONNECT host:port.
+func hostnameOf(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
 }
 
 // SwapSecrets atomically replaces the live secrets after validating the new envelope.
 // Validation and AllowedHosts equality checks are performed before acquiring the write lock.
-// Old enclaves are destroyed after the swap. Returns an error without modifying state on failure.
+// Old enclaves are destroyed, and cached access tokens and captured session cookies dropped. Returns an error without modifying state on failure.
 func (inj *Injector) SwapSecrets(newResult *secrets.UnsealResult, configAllowedHosts map[string][]string) error {
 	if err := newResult.Envelope.Validate(configAllowedHosts); err != nil {
 		return fmt.Errorf("reload validation failed: %w", err)
@@ -169,18 +489,42 @@ func (inj *Injector) SwapSecrets(newResult *secrets.UnsealResult, configAllowedH
 
 	inj.mu.RLock()
 	oldAllowedHosts := inj.envelope.AllowedHosts
+	oldAllowedMethods := inj.envelope.AllowedMethods
+	egress, egressAllowlist := inj.egress, inj.egressAllowlist
 	inj.mu.RUnlock()
 
+	// The live egress policy must be no weaker than the new envelope's, as at startup.
+	if err := newResult.Envelope.ValidateEgress(egress, egressAllowlist); err != nil {
+		return fmt.Errorf("reload validation failed: %w", err)
+	}
+
 	if err := allowedHostsEqual(oldAllowedHosts, newResult.Envelope.AllowedHosts); err != nil {
 		return fmt.Errorf("reload rejected (AllowedHosts changed — re-seal required): %w", err)
 	}
+	if err := bindingEqual("AllowedMethods", "method", oldAllowedMethods, newResult.Envelope.AllowedMethods); err != nil {
+		return fmt.Errorf("reload rejected (AllowedMethods changed — re-seal required): %w", err)
+	}
+
+	values, err := newSecretValues(newResult.LockedSecrets)
+	if err != nil {
+		return fmt.Errorf("reload failed: %w", err)
+	}
 
 	inj.mu.Lock()
 	old := inj.lockedSecrets
+	oldValues := inj.secretValues
 	inj.envelope = newResult.Envelope
 	inj.lockedSecrets = newResult.LockedSecrets
+	inj.secretValues = values
+	if inj.tokens != nil {
+		// A token still being minted from the old secrets is not cached.
+		inj.tokens.purge()
+	}
+	// Captured sessions belong to the cookies being replaced.
+	inj.sessions.purge()
 	inj.mu.Unlock()
 
+	oldValues.destroy()
 	for _, enc := range old {
 		if buf, err := enc.Open(); err == nil {
 			buf.Destroy()
@@ -191,26 +535,32 @@ func (inj *Injector) SwapSecrets(newResult *secrets.UnsealResult, configAllowedH
 
 // allowedHostsEqual returns nil iff old and new contain identical key/value sets.
 func allowedHostsEqual(old, new map[string][]string) error {
+	return bindingEqual("AllowedHosts", "host", old, new)
+}
+
+// bindingEqual returns nil iff the sealed binding maps old and new contain
+// identical key/value sets. kind and item name the map and its values in errors.
+func bindingEqual(kind, item string, old, new map[string][]string) error {
 	if len(old) != len(new) {
 		return fmt.Errorf("key count changed: %d → %d", len(old), len(new))
 	}
-	for secretName, oldHosts := range old {
-		newHosts, ok := new[secretName]
+	for secretName, oldValues := range old {
+		newValues, ok := new[secretName]
 		if !ok {
-			return fmt.Errorf("secret %q removed from AllowedHosts", secretName)
+			return fmt.Errorf("secret %q removed from %s", secretName, kind)
 		}
-		if len(oldHosts) != len(newHosts) {
-			return fmt.Errorf("secret %q host count changed: %d → %d", secretName, len(oldHosts), len(newHosts))
+		if len(oldValues) != len(newValues) {
+			return fmt.Errorf("secret %q %s count changed: %d → %d", secretName, item, len(oldValues), len(newValues))
 		}
-		newSet := make(map[string]struct{}, len(newHosts))
-		for _, h := range newHosts {
-			newSet[h] = struct{}{}
+		newSet := make(map[string]struct{}, len(newValues))
+		for _, v := range newValues {
+			newSet[v] = struct{}{}
 		}
-		for _, h := range oldHosts {
-			if _, ok := newSet[h]; !ok {
-				return fmt.Errorf("secret %q host %q removed from AllowedHosts", secretName, h)
+		for _, v := range oldValues {
+			if _, ok := newSet[v]; !ok {
+				return fmt.Errorf("secret %q %s %q removed from %s", secretName, item, v, kind)
 			}
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/awnumar/memguard"
+)
+
+// signJWT returns a compact RS256 JSON Web Token carrying claims, signed with
+// the PEM-encoded RSA private key keyPEM and naming kid, if set, as the key
+// ID. keyPEM is only read; the decoded key bytes are scrambled once the key
+// has been parsed.
+func signJWT(keyPEM []byte, kid string, claims any) (string, error) {
+	key, err := parseRSAKeyPEM(keyPEM)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+		Kid string `json:"kid,omitempty"`
+	}{"RS256", "JWT", kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing JWT: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseRSAKeyPEM parses a PKCS#1 or PKCS#8 RSA private key in PEM form.
+func parseRSAKeyPEM(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	defer memguard.ScrambleBytes(block.Bytes)
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private key is not a PKCS#1 or PKCS#8 key")
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key type %T is not RSA", key)
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// leafRenewMargin is how long before a cached leaf's expiry it is treated as
+// stale and re-signed, so clients never receive an almost-expired certificate.
+const leafRenewMargin = time.Hour
+
+// maxLeafLifetime caps leaf validity independently of the CA, which may be
+// sealed for a year or more: Apple and Chrome reject server certificates valid
+// for longer than 398 days.
+const maxLeafLifetime = 30 * 24 * time.Hour
+
+// signLeaf issues a server certificate for host signed by ca with caKey.
+// The leaf never outlives its CA, nor maxLeafLifetime.
+func signLeaf(ca *tls.Certificate, caKey crypto.PrivateKey, host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(maxLeafLifetime)
+	if ca.Leaf.NotAfter.Before(notAfter) {
+		notAfter = ca.Leaf.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"botlockbox MITM"},
+			CommonName:   host,
+		},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// leafCache is a bounded LRU of signed leaf certificates keyed by hostname.
+// Entries expire with their leaf, which never outlives the CA that signed it.
+type leafCache struct {
+	mu      sync.Mutex
+	maxSize int
+	order   *list.List // front = most recently used; values are *leafEntry
+	entries map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type leafEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newLeafCache(maxSize int) *leafCache {
+	return &leafCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns a fresh cached leaf for host, or nil.
+func (c *leafCache) get(host string) *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[host]
+	if !ok {
+		c.misses.Add(1)
+		return nil
+	}
+	entry := el.Value.(*leafEntry)
+	if time.Now().Add(leafRenewMargin).After(entry.cert.Leaf.NotAfter) {
+		c.order.Remove(el)
+		delete(c.entries, host)
+		c.misses.Add(1)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	c.hits.Add(1)
+	return entry.cert
+}
+
+// put stores cert for host, evicting the least recently used entry if full.
+func (c *leafCache) put(host string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[host]; ok {
+		el.Value.(*leafEntry).cert = cert
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[host] = c.order.PushFront(&leafEntry{host: host, cert: cert})
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*leafEntry).host)
+	}
+}
+
+// purge drops every cached leaf, e.g. after the signing CA changes.
+func (c *leafCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *leafCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func connectCtx(host string) *goproxy.ProxyCtx {
+	return &goproxy.ProxyCtx{
+		Req:   httptest.NewRequest(http.MethodConnect, host, nil),
+		Proxy: goproxy.NewProxyHttpServer(),
+	}
+}
+
+func TestCAManager_LeafCacheHitsAndMisses(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewCAManager(nil, 16)
+	if err != nil {
+		t.Fatalf("NewCAManager: %v", err)
+	}
+
+	first, err := m.TLSConfig("api.example.com:443", connectCtx("api.example.com:443"))
+	if err != nil {
+		t.Fatalf("TLSConfig: %v", err)
+	}
+	second, err := m.TLSConfig("api.example.com:443", connectCtx("api.example.com:443"))
+	if err != nil {
+		t.Fatalf("TLSConfig: %v", err)
+	}
+	if first.Certificates[0].Leaf != second.Certificates[0].Leaf {
+		t.Error("second handshake did not reuse the cached leaf")
+	}
+
+	hits, misses, size := m.LeafCacheStats()
+	if hits != 1 || misses != 1 || size != 1 {
+		t.Errorf("stats = (hits %d, misses %d, size %d), want (1, 1, 1)", hits, misses, size)
+	}
+}
+
+func TestCAManager_LeafCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewCAManager(nil, 2)
+	if err != nil {
+		t.Fatalf("NewCAManager: %v", err)
+	}
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com", "c.example.com"} {
+		if _, err := m.leafFor(host); err != nil {
+			t.Fatalf("leafFor(%q): %v", host, err)
+		}
+	}
+	if m.leaves.get("b.example.com") != nil {
+		t.Error("b.example.com should have been evicted")
+	}
+	if m.leaves.get("a.example.com") == nil || m.leaves.get("c.example.com") == nil {
+		t.Error("recently used entries were evicted")
+	}
+}
+
+func TestCAManager_PrewarmSurvivesRotation(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewCAManager(nil, 16)
+	if err != nil {
+		t.Fatalf("NewCAManager: %v", err)
+	}
+	if err := m.Prewarm([]string{"api.example.com"}); err != nil {
+		t.Fatalf("Prewarm: %v", err)
+	}
+	before := m.leaves.get("api.example.com")
+	if before == nil {
+		t.Fatal("prewarmed leaf not cached")
+	}
+
+	if err := m.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	after := m.leaves.get("api.example.com")
+	if after == nil {
+		t.Fatal("leaf not re-warmed after rotation")
+	}
+	if after == before {
+		t.Error("cache still holds a leaf signed by the retired CA")
+	}
+	m.mu.RLock()
+	active := m.current.cert.Leaf
+	m.mu.RUnlock()
+	if err := after.Leaf.CheckSignatureFrom(active); err != nil {
+		t.Errorf("re-warmed leaf not signed by the active CA: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/awnumar/memguard"
+	"github.com/trodemaster/botlockbox/internal/config"
+	"github.com/trodemaster/botlockbox/internal/tmpl"
+)
+
+// maxTokenResponseBytes bounds how much of a token endpoint response is read.
+const maxTokenResponseBytes = 1 << 20
+
+// oauth2Token describes the access token minted from the rule's sealed
+// client secret, injected as Authorization: Bearer on req.
+func (inj *Injector) oauth2Token(req *http.Request, rule config.Rule) mintedToken {
+	cfg := rule.Inject.OAuth2ClientCredentials
+	// Every input to the token request is part of the key, so rules that
+	// differ only in audience or resource never share a token.
+	params := make(url.Values, len(cfg.Params))
+	for name, value := range cfg.Params {
+		params.Set(name, value)
+	}
+	key := strings.Join([]string{"oauth2", cfg.TokenURL, cfg.ClientID, cfg.ClientSecret,
+		strings.Join(cfg.Scopes, " "), params.Encode(), cfg.AuthStyle}, "\x00")
+	return mintedToken{
+		kind:      "oauth2",
+		secret:    cfg.ClientSecret,
+		tokenHost: cfg.TokenHost(),
+		key:       key,
+		mint: func(secret *memguard.Enclave) ([]byte, time.Duration, error) {
+			return inj.mintOAuth2(cfg, secret)
+		},
+		set: func(token []byte) {
+			req.Header.Set("Authorization", "Bearer "+string(token))
+		},
+	}
+}
+
+// mintOAuth2 runs the client credentials grant against cfg.TokenURL.
+func (inj *Injector) mintOAuth2(cfg *config.OAuth2ClientCredentials, enc *memguard.Enclave) ([]byte, time.Duration, error) {
+	secret, err := openEnclave(cfg.ClientSecret, enc)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer secret.Destroy()
+
+	form := []byte("grant_type=client_credentials")
+	defer func() { memguard.ScrambleBytes(form) }()
+	addParam := func(name string, value []byte) {
+		form = append(form, '&')
+		form = append(form, tmpl.PercentEncode([]byte(name))...)
+		form = append(form, '=')
+		encoded := tmpl.PercentEncode(value)
+		form = append(form, encoded...)
+		memguard.ScrambleBytes(encoded)
+	}
+	if len(cfg.Scopes) > 0 {
+		addParam("scope", []byte(strings.Join(cfg.Scopes, " ")))
+	}
+	for name, value := range cfg.Params {
+		addParam(name, []byte(value))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cfg.TokenURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cfg.AuthStyle == config.OAuth2AuthBody {
+		addParam("client_id", []byte(cfg.ClientID))
+		addParam("client_secret", secret.Bytes())
+	} else {
+		// RFC 6749 §2.3.1: both halves are form-encoded before Basic encoding.
+		pair := tmpl.PercentEncode([]byte(cfg.ClientID))
+		pw := tmpl.PercentEncode(secret.Bytes())
+		pair = append(append(pair, ':'), pw...)
+		auth := make([]byte, base64.StdEncoding.EncodedLen(len(pair)))
+		base64.StdEncoding.Encode(auth, pair)
+		req.Header.Set("Authorization", "Basic "+string(auth))
+		memguard.ScrambleBytes(pw)
+		memguard.ScrambleBytes(pair)
+		memguard.ScrambleBytes(auth)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(form))
+	req.ContentLength = int64(len(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	return doTokenRequest(inj.tokens.client, req)
+}
+
+// doTokenRequest sends an OAuth 2.0 token request and returns the access
+// token from its JSON response, and the token's lifetime.
+func doTokenRequest(client *http.Client, req *http.Request) ([]byte, time.Duration, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseBytes))
+	defer memguard.ScrambleBytes(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return nil, 0, fmt.Errorf("token endpoint returned %d (%s)", resp.StatusCode, e.Error)
+		}
+		return nil, 0, fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+
+	var tr struct {
+		AccessToken json.RawMessage `json:"access_token"`
+		TokenType   string          `json:"token_type"`
+		ExpiresIn   json.Number     `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, 0, fmt.Errorf("decoding token response: %w", err)
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return nil, 0, fmt.Errorf("unsupported token_type %q", tr.TokenType)
+	}
+	token, err := rawJSONString(tr.AccessToken)
+	if err != nil || len(token) == 0 {
+		return nil, 0, fmt.Errorf("token response has no access_token")
+	}
+	var lifetime time.Duration
+	if tr.ExpiresIn != "" {
+		secs, err := strconv.ParseInt(string(tr.ExpiresIn), 10, 64)
+		if err != nil {
+			memguard.ScrambleBytes(token)
+			return nil, 0, fmt.Errorf("invalid expires_in %q", tr.ExpiresIn)
+		}
+		lifetime = time.Duration(secs) * time.Second
+	}
+	return token, lifetime, nil
+}
+
+// rawJSONString decodes the JSON string literal raw into a new slice,
+// without going through an immutable Go string.
+func rawJSONString(raw json.RawMessage) ([]byte, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return nil, fmt.Errorf("not a JSON string")
+	}
+	inner := raw[1 : len(raw)-1]
+	out := make([]byte, 0, len(inner))
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		if i++; i == len(inner) {
+			return nil, fmt.Errorf("truncated escape")
+		}
+		switch inner[i] {
+		case '"', '\\', '/':
+			out = append(out, inner[i])
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r, n := jsonUnicodeEscape(inner[i+1:])
+			if n == 0 {
+				return nil, fmt.Errorf("bad unicode escape")
+			}
+			out = utf8.AppendRune(out, r)
+			i += n
+		default:
+			return nil, fmt.Errorf("bad escape \\%c", inner[i])
+		}
+	}
+	return out, nil
+}
+
+// jsonUnicodeEscape decodes the hex digits following a \u escape at the start
+// of b, combining a UTF-16 surrogate pair if one follows. It returns the rune
+// and how many bytes of b it consumed, or 0 if b is malformed.
+func jsonUnicodeEscape(b []byte) (rune, int) {
+	if len(b) < 4 {
+		return 0, 0
+	}
+	v, err := strconv.ParseUint(string(b[:4]), 16, 16)
+	if err != nil {
+		return 0, 0
+	}
+	r := rune(v)
+	if utf16.IsSurrogate(r) && len(b) >= 10 && b[4] == '\\' && b[5] == 'u' {
+		if lo, err := strconv.ParseUint(string(b[6:10]), 16, 16); err == nil {
+			if pair := utf16.DecodeRune(r, rune(lo)); pair != utf8.RuneError {
+				return pair, 10
+			}
+		}
+	}
+	return r, 4
+}
@@ -10,34 +10,84 @@ import (
 )
 
 // New creates a goproxy server configured to inject credentials per the rules.
-// It returns the HTTP handler, the Injector (for live secret rotation via SwapSecrets), and any error.
+// It returns the HTTP handler, the Injector (for live secret rotation via SwapSecrets
+// and CA rotation via Injector.CA), and any error.
 func New(cfg *config.Config, result *secrets.UnsealResult) (http.Handler, *Injector, error) {
-	ephemeralCA, caCertPEM, err := GenerateEphemeralCA()
+	ca, err := newCA(cfg, result)
 	if err != nil {
-		return nil, nil, fmt.Errorf("generating ephemeral CA: %w", err)
+		return nil, nil, err
+	}
+
+	values, err := newSecretValues(result.LockedSecrets)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	p := goproxy.NewProxyHttpServer()
 	p.Verbose = cfg.Verbose
-	p.Tr = NewVerifyingTransport()
-
-	mitmConfig := goproxy.ConnectAction{
-		Action:    goproxy.ConnectMitm,
-		TLSConfig: goproxy.TLSConfigFromCA(ephemeralCA),
-	}
-	alwaysMitm := goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		return &mitmConfig, host
-	})
-	p.OnRequest().HandleConnect(alwaysMitm)
+	// Under the strip policy the agent's Accept-Encoding is dropped, so the
+	// transport asks for gzip only and decodes it transparently.
+	p.KeepAcceptEncoding = cfg.UnknownEncoding != config.UnknownEncodingStrip
 
 	injector := &Injector{
-		rules:         cfg.Rules,
-		envelope:      result.Envelope,
-		lockedSecrets: result.LockedSecrets,
-		CACertPEM:     caCertPEM,
+		rules:            cfg.Rules,
+		envelope:         result.Envelope,
+		lockedSecrets:    result.LockedSecrets,
+		secretValues:     values,
+		egress:           cfg.Egress,
+		egressAllowlist:  cfg.EgressAllowlist,
+		mitmHosts:        cfg.MITMHosts,
+		passthroughHosts: cfg.PassthroughHosts,
+		unknownEncoding:  cfg.UnknownEncoding,
+		scrubPatterns:    cfg.Scrub,
+		tokens:           newTokenCache(NewVerifyingTransport(nil)),
+		sessions:         newSessionJar(),
+		mitmAction: &goproxy.ConnectAction{
+			Action:    goproxy.ConnectMitm,
+			TLSConfig: ca.TLSConfig,
+		},
+		CA: ca,
 	}
+	p.Tr = NewVerifyingTransport(nil)
+	injector.upstream = p.Tr
+	if cfg.LeafCache.Prewarm {
+		if err := ca.Prewarm(injector.prewarmHosts()); err != nil {
+			return nil, nil, err
+		}
+	}
+	p.NonproxyHandler = http.HandlerFunc(injector.serveStats)
+	p.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(injector.HandleConnect))
 	p.OnRequest().DoFunc(injector.Handle)
-	InstallResponseScrubber(p)
+	p.OnResponse().DoFunc(injector.captureSessionCookies)
+	InstallResponseScrubber(p, injector)
 
 	return p, injector, nil
-}
\ No newline at end of file
+}
+
+// newCA loads the persistent CA sealed in the envelope if there is one, and
+// otherwise generates an ephemeral CA (name-constrained when configured).
+// With ca_name_constraints, a sealed CA must already be constrained to the
+// sealed hosts.
+func newCA(cfg *config.Config, result *secrets.UnsealResult) (*CAManager, error) {
+	var permittedHosts []string
+	if cfg.CANameConstraints {
+		permittedHosts = result.Envelope.SealedHosts()
+		if len(permittedHosts) == 0 {
+			return nil, fmt.Errorf("ca_name_constraints is set but the sealed envelope commits no hosts")
+		}
+	}
+
+	if result.Envelope.CA != nil {
+		if result.LockedCAKey == nil {
+			return nil, fmt.Errorf("sealed envelope has a CA certificate but its private key was not unsealed")
+		}
+		certPEM := []byte(result.Envelope.CA.CertPEM)
+		if cfg.CANameConstraints {
+			if err := CheckCANameConstraints(certPEM, permittedHosts); err != nil {
+				return nil, fmt.Errorf("sealed CA: %w", err)
+			}
+		}
+		return NewSealedCAManager(certPEM, result.LockedCAKey, cfg.LeafCache.Size)
+	}
+	return NewCAManager(permittedHosts, cfg.LeafCache.Size)
+}
@@ -2,44 +2,317 @@ package proxy
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
 )
 
-var credentialPatterns = []*regexp.Regexp{
-	regexp.MustCompile(`ghp_[a-zA-Z0-9]{36}`),
-	regexp.MustCompile(`ghs_[a-zA-Z0-9]{36}`),
-	regexp.MustCompile(`sk-[a-zA-Z0-9]{48}`),
-	regexp.MustCompile(`sk-proj-[a-zA-Z0-9_\-]{50,}`),
-	regexp.MustCompile(`AKIA[A-Z0-9]{16}`),
-	regexp.MustCompile(`(?i)"access_token"\s*:.*"[^"]+"`),
-	regexp.MustCompile(`(?i)"refresh_token"\s*:.*"[^"]+"`),
-	regexp.MustCompile(`(?i)"api_key"\s*:.*"[^"]+"`),
+// scrubPattern is a named pattern the scrubber redacts.
+type scrubPattern struct {
+	name string
+	re   *regexp.Regexp
+	repl []byte // regexp.Expand template
 }
 
-var redacted = []byte("[REDACTED-BY-BOTLOCKBOX]")
+func builtinPattern(name, expr string) scrubPattern {
+	return scrubPattern{name: name, re: regexp.MustCompile(expr), repl: redacted}
+}
+
+var credentialPatterns = []scrubPattern{
+	builtinPattern("github_pat", `ghp_[a-zA-Z0-9]{36}`),
+	builtinPattern("github_app_token", `ghs_[a-zA-Z0-9]{36}`),
+	builtinPattern("openai_key", `sk-[a-zA-Z0-9]{48}`),
+	builtinPattern("openai_project_key", `sk-proj-[a-zA-Z0-9_\-]{50,}`),
+	builtinPattern("aws_access_key_id", `AKIA[A-Z0-9]{16}`),
+	builtinPattern("access_token_field", `(?i)"access_token"\s*:.*"[^"]+"`),
+	builtinPattern("refresh_token_field", `(?i)"refresh_token"\s*:.*"[^"]+"`),
+	builtinPattern("api_key_field", `(?i)"api_key"\s*:.*"[^"]+"`),
+}
+
+// sealedSecretPattern is the audit name for redacted loaded secret values.
+const sealedSecretPattern = "sealed_secret"
+
+var redacted = []byte(config.DefaultScrubReplacement)
+
+// scrubWindow is how many trailing bytes the streaming scrubber holds back
+// between reads. A credential up to this long (or the longest loaded secret
+// encoding, if longer) is redacted even when it is split across reads; only
+// a pattern match longer than the window can escape.
+const scrubWindow = 4096
+
+// scrubReadSize is the size of each read from the upstream body.
+const scrubReadSize = 32 << 10
 
 // InstallResponseScrubber adds a response handler that redacts known
-// credential patterns from response bodies before forwarding to agents.
-func InstallResponseScrubber(p *goproxy.ProxyHttpServer) {
+// credential patterns, the exact values of every secret inj holds, and the
+// configured scrub patterns (global, plus those of the rules that matched the
+// request) from response bodies before forwarding to agents. Bodies are scrubbed as
+// they stream, so server-sent events reach the agent event by event and large
+// bodies are never buffered whole. Binary content types are scrubbed of the
+// secret values and the configured patterns that list them, but not the
+// built-in patterns. Compressed bodies are decoded and forwarded identity-encoded; a coding that
+// cannot be decoded is refused with a 502 unless the unknown_encoding policy
+// is "pass".
+func InstallResponseScrubber(p *goproxy.ProxyHttpServer, inj *Injector) {
 	p.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-		if resp == nil {
-			return nil
+		if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+			return resp
 		}
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			resp.Body = io.NopCloser(bytes.NewReader(body))
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		rules, _ := ctx.UserData.([]*config.Rule)
+		patterns, values := inj.responsePatterns(mediaType, rules)
+		if len(patterns) == 0 && !values {
 			return resp
 		}
-		for _, re := range credentialPatterns {
-			body = re.ReplaceAll(body, redacted)
+		if codings := contentCodings(resp.Header); len(codings) > 0 {
+			if c := unsupportedCoding(codings); c != "" {
+				if inj != nil && inj.unknownEncoding == config.UnknownEncodingPass {
+					ctx.Warnf("Passing %s response with Content-Encoding %q unscrubbed", mediaType, c)
+					return resp
+				}
+				return refuseEncoded(resp, ctx, fmt.Sprintf("unsupported Content-Encoding %q", c))
+			}
+			body, err := decodeBody(resp.Body, codings)
+			if err != nil {
+				return refuseEncoded(resp, ctx, err.Error())
+			}
+			resp.Body = body
+			resp.Header.Del("Content-Encoding")
+			resp.Uncompressed = true
 		}
-		resp.Body = io.NopCloser(bytes.NewReader(body))
-		resp.ContentLength = int64(len(body))
+		sr := &scrubReader{
+			src:      resp.Body,
+			inj:      inj,
+			sse:      mediaType == "text/event-stream",
+			patterns: patterns,
+			values:   values,
+			req:      ctx.Req,
+		}
+		for i, rule := range rules {
+			if i > 0 {
+				sr.ruleName += ","
+			}
+			sr.ruleName += rule.Name
+		}
+		resp.Body = sr
+		// Redaction changes the length; let goproxy re-frame the body.
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
 		return resp
 	})
-}
\ No newline at end of file
+}
+
+// refuseEncoded replaces a response the scrubber cannot decode with a 502.
+func refuseEncoded(resp *http.Response, ctx *goproxy.ProxyCtx, reason string) *http.Response {
+	resp.Body.Close()
+	LogAuditEvent(ctx.Req, "", "", false, true, "response cannot be scrubbed: "+reason)
+	return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway,
+		"botlockbox: response cannot be scrubbed: "+reason)
+}
+
+// scrubbable reports whether a response of mediaType can carry text worth
+// scrubbing. An absent Content-Type is treated as text.
+func scrubbable(mediaType string) bool {
+	switch {
+	case mediaType == "", strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml",
+		"application/javascript", "application/x-www-form-urlencoded", "application/graphql-response+json":
+		return true
+	}
+	return false
+}
+
+// responsePatterns selects the patterns to run over a response of mediaType
+// and whether the loaded secret values are redacted too. The secret values
+// are redacted from every response and the built-in patterns from text
+// responses; a configured pattern applies to the media types it lists, or to
+// every text response if it lists none.
+func (inj *Injector) responsePatterns(mediaType string, rules []*config.Rule) ([]scrubPattern, bool) {
+	text := scrubbable(mediaType)
+	var patterns []scrubPattern
+	if text {
+		patterns = append(patterns, credentialPatterns...)
+	}
+	var configured []config.ScrubPattern
+	if inj != nil {
+		configured = append(configured, inj.scrubPatterns...)
+	}
+	for _, rule := range rules {
+		configured = append(configured, rule.Scrub...)
+	}
+	for i := range configured {
+		c := &configured[i]
+		if c.Regexp() == nil {
+			continue
+		}
+		applies := text
+		if len(c.ContentTypes) > 0 {
+			applies = mediaTypeMatches(mediaType, c.ContentTypes)
+		}
+		if applies {
+			patterns = append(patterns, scrubPattern{name: c.Name, re: c.Regexp(), repl: []byte(c.Replacement)})
+		}
+	}
+	return patterns, inj != nil
+}
+
+// mediaTypeMatches reports whether mediaType matches any of patterns, which
+// may use a "type/*" or "*/*" wildcard.
+func mediaTypeMatches(mediaType string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == mediaType || p == "*/*" ||
+			strings.HasSuffix(p, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubReader redacts a response body as it is read. Scrubbed bytes are
+// released as soon as no match could still extend into them: for
+// server-sent events that is every complete event, otherwise everything but
+// the trailing hold-back window and any match that reaches into it.
+type scrubReader struct {
+	src      io.ReadCloser
+	inj      *Injector
+	sse      bool
+	patterns []scrubPattern
+	values   bool // redact the loaded secret values
+
+	// req and ruleName identify the audit event logged on Close; counts
+	// tallies redactions per pattern name.
+	req      *http.Request
+	ruleName string
+	counts   map[string]int
+	closed   bool
+
+	buf   []byte // scrubbed bytes not yet returned
+	ready int    // leading bytes of buf that may be returned
+	err   error
+}
+
+func (s *scrubReader) Read(p []byte) (int, error) {
+	for s.ready == 0 && s.err == nil {
+		start := len(s.buf)
+		s.buf = slices.Grow(s.buf, scrubReadSize)
+		n, err := s.src.Read(s.buf[start : start+scrubReadSize])
+		s.buf = s.buf[:start+n]
+		if err != nil {
+			s.err = err
+		}
+		if n > 0 || err != nil {
+			s.buf, s.ready = s.scrub(s.buf, err != nil)
+		}
+	}
+	if s.ready == 0 {
+		return 0, s.err
+	}
+	n := copy(p, s.buf[:s.ready])
+	s.ready -= n
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+	return n, nil
+}
+
+// commitLimit returns how many leading bytes of b can no longer be part of
+// a match, given that matches up to hold bytes long are caught.
+func (s *scrubReader) commitLimit(b []byte, hold int) int {
+	limit := len(b) - hold
+	if s.sse {
+		if i := bytes.LastIndex(b, []byte("\n\n")); i >= 0 && i+2 > limit {
+			limit = i + 2
+		}
+		if i := bytes.LastIndex(b, []byte("\r\n\r\n")); i >= 0 && i+4 > limit {
+			limit = i + 4
+		}
+	}
+	return max(limit, 0)
+}
+
+// Close closes the upstream body and logs an audit event naming every
+// pattern that redacted something, with its match count.
+func (s *scrubReader) Close() error {
+	if !s.closed && len(s.counts) > 0 && s.req != nil {
+		evt := newAuditEvent(s.req, s.ruleName, "", false, false, "")
+		evt.Redactions = s.counts
+		evt.Log()
+	}
+	s.closed = true
+	return s.src.Close()
+}
+
+// scrub redacts the loaded secret values (and their encodings) and s's
+// patterns in b, and returns the result and how many of its leading bytes
+// may be released. Unless final is set, a pattern match ending in the
+// hold-back window is left for the next read, since more input could still
+// extend it, and nothing from its start on is released.
+func (s *scrubReader) scrub(b []byte, final bool) ([]byte, int) {
+	hold := scrubWindow
+	if s.values {
+		var n int
+		s.inj.mu.RLock()
+		b, n = s.inj.secretValues.redact(b)
+		if s.inj.secretValues != nil && s.inj.secretValues.maxLen > hold {
+			hold = s.inj.secretValues.maxLen
+		}
+		s.inj.mu.RUnlock()
+		s.count(sealedSecretPattern, n)
+	}
+	limit := len(b)
+	if !final {
+		limit = s.commitLimit(b, hold)
+	}
+	for _, p := range s.patterns {
+		var n int
+		b, n, limit = p.replace(b, limit)
+		s.count(p.name, n)
+	}
+	return b, limit
+}
+
+func (s *scrubReader) count(name string, n int) {
+	if n == 0 {
+		return
+	}
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+	s.counts[name] += n
+}
+
+// replace expands p.repl in place of every match of p in b that ends
+// within the first limit bytes. It returns the result, the number of
+// matches replaced, and limit moved to the same place in the result, or back
+// to the start of the first match left unreplaced if that is earlier.
+func (p scrubPattern) replace(b []byte, limit int) ([]byte, int, int) {
+	matches := p.re.FindAllSubmatchIndex(b, -1)
+	if len(matches) == 0 {
+		return b, 0, limit
+	}
+	out := make([]byte, 0, len(b))
+	last, n := 0, 0
+	for _, m := range matches {
+		if m[1] > limit {
+			limit = min(limit, m[0])
+			break
+		}
+		out = append(out, b[last:m[0]]...)
+		out = p.re.Expand(out, p.repl, b, m)
+		last = m[1]
+		n++
+	}
+	limit = len(out) + limit - last
+	return append(out, b[last:]...), n, limit
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/elazarl/goproxy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// proxyResponse serves upstream through a goproxy server with the response
+// scrubber installed and returns the response the agent sees.
+func proxyResponse(t *testing.T, inj *Injector, upstream http.HandlerFunc) *http.Response {
+	t.Helper()
+	origin := httptest.NewServer(upstream)
+	t.Cleanup(origin.Close)
+
+	p := goproxy.NewProxyHttpServer()
+	InstallResponseScrubber(p, inj)
+	front := httptest.NewServer(p)
+	t.Cleanup(front.Close)
+
+	proxyURL, _ := url.Parse(front.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestResponseScrubber_RedactsSecretValues(t *testing.T) {
+	t.Parallel()
+
+	const secret = "xoxb-internal/7f3a9c+"
+	inj := makeInjector(map[string][]string{"slack": {"slack.com"}}, map[string]string{"slack": secret})
+
+	cases := []struct {
+		name   string
+		leaked string
+	}{
+		{"raw", secret},
+		{"base64", base64.StdEncoding.EncodeToString([]byte(secret))},
+		{"urlencoded", url.QueryEscape(secret)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			resp := proxyResponse(t, inj, func(w http.ResponseWriter, _ *http.Request) {
+				io.WriteString(w, `{"error":"invalid_auth","echo":"`+tc.leaked+`"}`)
+			})
+			got, _ := io.ReadAll(resp.Body)
+			if strings.Contains(string(got), tc.leaked[:len(tc.leaked)-4]) || !strings.Contains(string(got), string(redacted)) {
+				t.Errorf("body = %q, want %s form redacted", got, tc.name)
+			}
+		})
+	}
+}
+
+func TestResponseScrubber_StreamsServerSentEvents(t *testing.T) {
+	t.Parallel()
+
+	const secret = "sk-ant-api03-streamed"
+	inj := makeInjector(map[string][]string{"anthropic": {"api.anthropic.com"}}, map[string]string{"anthropic": secret})
+	release := make(chan struct{})
+
+	resp := proxyResponse(t, inj, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"key\":\""+secret+"\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: done\n\n")
+	})
+	defer close(release)
+
+	first := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		first <- line
+	}()
+	select {
+	case line := <-first:
+		if strings.Contains(line, secret) || !strings.Contains(line, string(redacted)) {
+			t.Errorf("first event = %q, want secret redacted", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first event was held back until the stream ended")
+	}
+}
+
+func TestResponseScrubber_RedactsAcrossReads(t *testing.T) {
+	t.Parallel()
+
+	const secret = "split-secret-value-0123"
+	inj := makeInjector(map[string][]string{"k": {"api.example.com"}}, map[string]string{"k": secret})
+
+	resp := proxyResponse(t, inj, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, strings.Repeat(" ", 3*scrubReadSize)+`{"echo":"`+secret[:9])
+		w.(http.Flusher).Flush()
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(w, secret[9:]+`"}`)
+	})
+	got, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(got), secret[:9]) {
+		t.Errorf("secret split across reads was not redacted: %q", strings.TrimSpace(string(got)))
+	}
+}
+
+func TestResponseScrubber_VariableLengthMatchAcrossReads(t *testing.T) {
+	t.Parallel()
+
+	pad := strings.Repeat(" ", scrubWindow+100)
+	key := "sk-proj-" + strings.Repeat("a1B2", 20)
+	for _, tc := range []struct {
+		name, body, tail string
+		split            int // offset in body of the read boundary
+	}{
+		{"openai project key", pad + key + " rest", key[60:], len(pad) + 60},
+		{"access_token field", pad + `{"access_token": "abc", "scope": "` + strings.Repeat("t0k", 20) + `"}`, "t0k", len(pad) + 60},
+		{"split near end of window", key + pad, key[60:], 60},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			sr := &scrubReader{
+				src: io.NopCloser(io.MultiReader(
+					strings.NewReader(tc.body[:tc.split]), strings.NewReader(tc.body[tc.split:]))),
+				patterns: credentialPatterns,
+			}
+			got, err := io.ReadAll(sr)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if strings.Contains(string(got), tc.tail) {
+				t.Errorf("tail of a credential split across reads was released: %q", strings.TrimSpace(string(got)))
+			}
+			if n := bytes.Count(got, redacted); n != 1 {
+				t.Errorf("got %d redactions, want 1: %q", n, strings.TrimSpace(string(got)))
+			}
+		})
+	}
+}
+
+func TestResponseScrubber_BinaryRedactsOnlySecretValues(t *testing.T) {
+	t.Parallel()
+
+	const secret = "binary-secret-value"
+	inj := makeInjector(map[string][]string{"k": {"api.example.com"}}, map[string]string{"k": secret})
+	// A built-in pattern match in a binary body could be arbitrary bytes, so
+	// only the exact secret values are redacted there.
+	pat := "ghp_" + strings.Repeat("x", 36)
+
+	for _, mediaType := range []string{"application/octet-stream", "image/png", "application/x-unknown"} {
+		t.Run(mediaType, func(t *testing.T) {
+			t.Parallel()
+			resp := proxyResponse(t, inj, func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", mediaType)
+				io.WriteString(w, "\x00\x01"+secret+"\x02"+pat)
+			})
+			got, _ := io.ReadAll(resp.Body)
+			if want := "\x00\x01" + string(redacted) + "\x02" + pat; string(got) != want {
+				t.Errorf("body = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestResponseScrubber_DecodesContentEncodings(t *testing.T) {
+	t.Parallel()
+
+	const secret = "compressed-secret-value"
+	body := `{"echo":"` + secret + `"}`
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		io.WriteString(w, body)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	cases := []struct {
+		coding string
+		data   []byte
+	}{
+		{"gzip", compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })},
+		{"deflate", compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })},
+		{"deflate", compress(func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw })},
+		{"br", compress(func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) })},
+		{"zstd", compress(func(w io.Writer) io.WriteCloser { zw, _ := zstd.NewWriter(w); return zw })},
+	}
+	for _, tc := range cases {
+		t.Run(tc.coding, func(t *testing.T) {
+			t.Parallel()
+			inj := makeInjector(map[string][]string{"k": {"api.example.com"}}, map[string]string{"k": secret})
+			resp := proxyResponse(t, inj, func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", tc.coding)
+				w.Write(tc.data)
+			})
+			got, _ := io.ReadAll(resp.Body)
+			if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+				t.Errorf("Content-Encoding = %q, want identity", enc)
+			}
+			if string(got) != `{"echo":"`+string(redacted)+`"}` {
+				t.Errorf("body = %q, want decoded and redacted", got)
+			}
+		})
+	}
+}
+
+func TestResponseScrubber_UnknownEncodingPolicy(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		policy     string
+		wantStatus int
+	}{
+		{config.UnknownEncodingStrip, http.StatusBadGateway},
+		{config.UnknownEncodingBlock, http.StatusBadGateway},
+		{config.UnknownEncodingPass, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			t.Parallel()
+			inj := makeInjector(nil, nil)
+			inj.unknownEncoding = tc.policy
+			resp := proxyResponse(t, inj, func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Encoding", "compress")
+				io.WriteString(w, "opaque")
+			})
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestResponseScrubber_ConfiguredPatterns(t *testing.T) {
+	t.Parallel()
+
+	global := []config.ScrubPattern{
+		{Name: "internal_token", Pattern: `itk_[a-z0-9]{8}`},
+		{Name: "json_only", Pattern: `sess-[0-9]+`, Replacement: "sess-***", ContentTypes: []string{"application/json"}},
+	}
+	rule := &config.Rule{Name: "blobs", Scrub: []config.ScrubPattern{
+		{Name: "blob_key", Pattern: `(key=)[A-F0-9]{6}`, Replacement: "${1}hidden", ContentTypes: []string{"application/*"}},
+	}}
+	for i := range global {
+		if err := global[i].Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rule.Scrub[0].Compile(); err != nil {
+		t.Fatal(err)
+	}
+	inj := makeInjector(nil, nil)
+	inj.scrubPatterns = global
+
+	cases := []struct {
+		name       string
+		mediaType  string
+		rules      []*config.Rule
+		body       string
+		want       string
+		wantCounts map[string]int
+	}{
+		{"global on text", "text/plain", nil, "a itk_abcd1234 b itk_00000000 sess-1",
+			"a [REDACTED-BY-BOTLOCKBOX] b [REDACTED-BY-BOTLOCKBOX] sess-1", map[string]int{"internal_token": 2}},
+		{"content type filter", "application/json", nil, `{"s":"sess-42"}`,
+			`{"s":"sess-***"}`, map[string]int{"json_only": 1}},
+		{"rule pattern on binary type", "application/octet-stream", []*config.Rule{rule}, "key=ABC123 itk_abcd1234",
+			"key=hidden itk_abcd1234", map[string]int{"blob_key": 1}},
+		{"rule pattern not applied without rule", "application/octet-stream", nil, "key=ABC123", "key=ABC123", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			patterns, values := inj.responsePatterns(tc.mediaType, tc.rules)
+			if len(patterns) == 0 && !values {
+				if tc.want != "" {
+					t.Fatal("no patterns selected")
+				}
+				return
+			}
+			sr := &scrubReader{src: io.NopCloser(strings.NewReader(tc.body)), inj: inj, patterns: patterns, values: values}
+			got, _ := io.ReadAll(sr)
+			if string(got) != tc.want {
+				t.Errorf("body = %q, want %q", got, tc.want)
+			}
+			if fmt.Sprint(sr.counts) != fmt.Sprint(tc.wantCounts) {
+				t.Errorf("counts = %v, want %v", sr.counts, tc.wantCounts)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/trodemaster/botlockbox/internal/config"
+	"github.com/trodemaster/botlockbox/internal/matcher"
+)
+
+// ruleEntry is one (rule, host pattern, path prefix) combination. Rules are
+// evaluated entry by entry, so a rule listing both an exact host and a
+// wildcard ranks by whichever of them the request actually matched.
+type ruleEntry struct {
+	index  int // position in Injector.rules
+	host   string
+	prefix string
+}
+
+// resolveRuleOrder returns the entries of rules in precedence order: higher
+// priority first, then exact host before wildcard (longer wildcard suffix
+// before shorter), then longer path prefix before shorter, then config order.
+func resolveRuleOrder(rules []config.Rule) []ruleEntry {
+	var entries []ruleEntry
+	for i, rule := range rules {
+		prefixes := rule.Match.PathPrefixes
+		if len(prefixes) == 0 {
+			prefixes = []string{""}
+		}
+		for _, host := range rule.Match.Hosts {
+			for _, prefix := range prefixes {
+				entries = append(entries, ruleEntry{index: i, host: host, prefix: prefix})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(a, b int) bool {
+		ea, eb := entries[a], entries[b]
+		if pa, pb := rules[ea.index].Priority, rules[eb.index].Priority; pa != pb {
+			return pa > pb
+		}
+		if sa, sb := hostSpecificity(ea.host), hostSpecificity(eb.host); sa != sb {
+			return sa > sb
+		}
+		if len(ea.prefix) != len(eb.prefix) {
+			return len(ea.prefix) > len(eb.prefix)
+		}
+		return ea.index < eb.index
+	})
+	return entries
+}
+
+// hostSpecificity ranks an exact host above every wildcard, and a wildcard
+// by the length of the suffix it requires.
+func hostSpecificity(pattern string) int {
+	if strings.HasPrefix(pattern, "*.") {
+		return len(pattern) - 1
+	}
+	return math.MaxInt
+}
+
+// ruleOrder returns the resolved evaluation order, computing it on first use.
+func (inj *Injector) ruleOrder() []ruleEntry {
+	inj.orderOnce.Do(func() {
+		inj.order = resolveRuleOrder(inj.rules)
+	})
+	return inj.order
+}
+
+// RuleOrder describes the resolved rule evaluation order, one line per
+// entry, for logging at startup.
+func (inj *Injector) RuleOrder() []string {
+	var lines []string
+	for n, e := range inj.ruleOrder() {
+		rule := inj.rules[e.index]
+		line := fmt.Sprintf("%d. %s (priority %d) host=%s", n+1, rule.Name, rule.Priority, e.host)
+		if e.prefix != "" {
+			line += " path=" + e.prefix + "*"
+		}
+		if len(rule.Match.Methods) > 0 {
+			line += " methods=" + strings.Join(rule.Match.Methods, ",")
+		}
+		if rule.Continue {
+			line += " continue"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// matchingRules returns the rules that apply to req, in precedence order:
+// the first match, plus every further match for as long as the rules matched
+// so far set continue. Callers must hold inj.mu.
+func (inj *Injector) matchingRules(req *http.Request) []*config.Rule {
+	host := req.URL.Hostname()
+	var matched []*config.Rule
+	seen := make(map[int]bool)
+	for _, e := range inj.ruleOrder() {
+		if seen[e.index] || !matcher.HostMatches(host, e.host) || !strings.HasPrefix(req.URL.Path, e.prefix) {
+			continue
+		}
+		rule := &inj.rules[e.index]
+		if !matcher.Matches(req, rule.Match) {
+			continue
+		}
+		seen[e.index] = true
+		matched = append(matched, rule)
+		if !rule.Continue {
+			break
+		}
+	}
+	return matched
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+// errSealedCA is returned when asked to rotate a CA loaded from the envelope.
+var errSealedCA = errors.New("the MITM CA is sealed in the envelope and cannot be rotated by serve -- re-run `botlockbox seal` with a new CA")
+
+// GeneratePersistentCA creates a long-lived CA for `botlockbox seal --generate-ca`.
+// If permittedHosts is non-nil, the CA is name-constrained to those host patterns.
+// Callers own keyPEM and must scramble it once it has been sealed.
+func GeneratePersistentCA(lifetime time.Duration, permittedHosts []string) (certPEM, keyPEM []byte, err error) {
+	return generateCA("botlockbox sealed CA", lifetime, permittedHosts)
+}
+
+// ValidateCAKeyPair checks that certPEM is a currently valid CA certificate
+// and keyPEM is its private key.
+func ValidateCAKeyPair(certPEM, keyPEM []byte) error {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("loading CA key pair: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing CA certificate: %w", err)
+	}
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("certificate %q is not a CA (needs basicConstraints CA:TRUE and keyCertSign)", cert.Subject)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("CA certificate %q expired at %s", cert.Subject, cert.NotAfter)
+	}
+	return nil
+}
+
+// CheckCANameConstraints checks that the CA in certPEM is name-constrained and
+// that its constraints cover every pattern in hosts, for ca_name_constraints
+// with a CA that botlockbox did not generate itself.
+func CheckCANameConstraints(certPEM []byte, hosts []string) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("CA certificate is not a PEM CERTIFICATE block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing CA certificate: %w", err)
+	}
+	if len(cert.PermittedDNSDomains) == 0 && len(cert.PermittedIPRanges) == 0 {
+		return fmt.Errorf("ca_name_constraints is set but CA certificate %q carries no permitted name constraints", cert.Subject)
+	}
+	for _, host := range hosts {
+		if !constraintsCover(cert, host) {
+			return fmt.Errorf("ca_name_constraints is set but CA certificate %q does not permit sealed host %q -- permitted: %v",
+				cert.Subject, host, permittedHostsFromCert(cert))
+		}
+	}
+	return nil
+}
+
+// constraintsCover reports whether cert's permitted name constraints admit
+// every name host matches, where host is an exact name, IP literal or
+// "*.domain" glob.
+func constraintsCover(cert *x509.Certificate, host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range cert.PermittedIPRanges {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, constraint := range cert.PermittedDNSDomains {
+		constraint = strings.ToLower(constraint)
+		if base, ok := strings.CutPrefix(host, "*."); ok {
+			// Only "domain" or ".domain" (or a parent of either) admits every subdomain.
+			if constraint == "."+base || dnsConstraintCovers(constraint, base) {
+				return true
+			}
+		} else if dnsConstraintCovers(constraint, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsConstraintCovers applies RFC 5280 dNSName constraint matching as Go's
+// verifier does: "example.com" admits the domain and its subdomains, while
+// ".example.com" admits subdomains only.
+func dnsConstraintCovers(constraint, name string) bool {
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+// NewSealedCAManager builds a CAManager around the persistent CA committed in
+// the sealed envelope. keyDER holds the CA private key in DER form; it is only
+// opened while signing a leaf certificate. Sealed CAs cannot be rotated.
+func NewSealedCAManager(certPEM []byte, keyDER *memguard.Enclave, leafCacheSize int) (*CAManager, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("sealed CA certificate is not a PEM CERTIFICATE block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing sealed CA certificate: %w", err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("sealed CA certificate expired at %s -- re-run `botlockbox seal` with a new CA", cert.NotAfter)
+	}
+
+	ca := issuedCA{
+		cert:      &tls.Certificate{Certificate: [][]byte{cert.Raw}, Leaf: cert},
+		sealedKey: keyDER,
+		pem:       certPEM,
+		notAfter:  cert.NotAfter,
+	}
+	if err := ca.withKey(func(key crypto.Signer) error {
+		pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(cert.PublicKey) {
+			return fmt.Errorf("sealed CA private key does not match its certificate")
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &CAManager{
+		current:        ca,
+		permittedHosts: permittedHostsFromCert(cert),
+		leaves:         newLeafCache(leafCacheSize),
+	}, nil
+}
+
+// withKey opens the sealed CA key for the duration of fn.
+func (ca issuedCA) withKey(fn func(crypto.Signer) error) error {
+	buf, err := ca.sealedKey.Open()
+	if err != nil {
+		return fmt.Errorf("opening memguard enclave for sealed CA key: %w", err)
+	}
+	defer buf.Destroy()
+	key, err := parsePrivateKey(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("sealed CA key: %w", err)
+	}
+	return fn(key)
+}
+
+// parsePrivateKey parses a DER private key in PKCS#8, SEC 1 (EC) or PKCS#1 (RSA) form.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key type %T cannot sign", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("not a PKCS#8, EC or PKCS#1 private key")
+}
+
+// permittedHostsFromCert converts a CA's DNS and IP name constraints back into
+// host patterns for CAManager.Permits. It returns nil for an unconstrained CA.
+func permittedHostsFromCert(cert *x509.Certificate) []string {
+	if len(cert.PermittedDNSDomains) == 0 && len(cert.PermittedIPRanges) == 0 {
+		return nil
+	}
+	var hosts []string
+	for _, domain := range cert.PermittedDNSDomains {
+		if len(domain) > 0 && domain[0] == '.' {
+			domain = "*" + domain
+		}
+		hosts = append(hosts, domain)
+	}
+	for _, ipNet := range cert.PermittedIPRanges {
+		if ones, bits := ipNet.Mask.Size(); ones == bits {
+			hosts = append(hosts, net.IP(ipNet.IP).String())
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+// sealedCA generates a persistent CA and returns its certificate PEM and a
+// memguard enclave holding the DER private key, as serve's unseal does.
+func sealedCA(t *testing.T, permittedHosts []string) ([]byte, *memguard.Enclave) {
+	t.Helper()
+	certPEM, keyPEM, err := GeneratePersistentCA(48*time.Hour, permittedHosts)
+	if err != nil {
+		t.Fatalf("GeneratePersistentCA: %v", err)
+	}
+	if err := ValidateCAKeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("ValidateCAKeyPair: %v", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	return certPEM, memguard.NewEnclave(block.Bytes)
+}
+
+func TestNewSealedCAManager_SignsLeaves(t *testing.T) {
+	t.Parallel()
+
+	certPEM, key := sealedCA(t, []string{"*.example.com"})
+	m, err := NewSealedCAManager(certPEM, key, 16)
+	if err != nil {
+		t.Fatalf("NewSealedCAManager: %v", err)
+	}
+	if m.Rotatable() {
+		t.Error("sealed CA reports itself as rotatable")
+	}
+	if err := m.Rotate(); err == nil {
+		t.Error("Rotate on a sealed CA returned nil error")
+	}
+	if !m.Permits("api.example.com") || m.Permits("api.example.net") {
+		t.Error("Permits does not reflect the sealed CA's name constraints")
+	}
+
+	tlsCfg, err := m.TLSConfig("api.example.com:443", connectCtx("api.example.com:443"))
+	if err != nil {
+		t.Fatalf("TLSConfig: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	leaf := tlsCfg.Certificates[0].Leaf
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "api.example.com", Roots: roots}); err != nil {
+		t.Errorf("leaf does not verify against the sealed CA: %v", err)
+	}
+	if got := m.BundlePEM(); string(got) != string(certPEM) {
+		t.Error("BundlePEM differs from the sealed CA certificate")
+	}
+}
+
+func TestNewSealedCAManager_RejectsMismatchedKey(t *testing.T) {
+	t.Parallel()
+
+	certPEM, _ := sealedCA(t, nil)
+	_, otherKey := sealedCA(t, nil)
+	if _, err := NewSealedCAManager(certPEM, otherKey, 16); err == nil {
+		t.Fatal("expected error for a key that does not match the certificate")
+	}
+}
+
+func TestNewSealedCAManager_CapsLeafLifetime(t *testing.T) {
+	t.Parallel()
+
+	certPEM, keyPEM, err := GeneratePersistentCA(365*24*time.Hour, nil)
+	if err != nil {
+		t.Fatalf("GeneratePersistentCA: %v", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	m, err := NewSealedCAManager(certPEM, memguard.NewEnclave(block.Bytes), 16)
+	if err != nil {
+		t.Fatalf("NewSealedCAManager: %v", err)
+	}
+	leaf, err := m.leafFor("api.example.com")
+	if err != nil {
+		t.Fatalf("leafFor: %v", err)
+	}
+	if limit := time.Now().Add(maxLeafLifetime); leaf.Leaf.NotAfter.After(limit) {
+		t.Errorf("leaf NotAfter = %v, want no later than %v", leaf.Leaf.NotAfter, limit)
+	}
+}
+
+func TestCheckCANameConstraints(t *testing.T) {
+	t.Parallel()
+
+	constrained, _ := sealedCA(t, []string{"*.example.com", "api.github.com", "10.0.0.1"})
+	unconstrained, _ := sealedCA(t, nil)
+
+	cases := []struct {
+		name    string
+		certPEM []byte
+		hosts   []string
+		wantErr bool
+	}{
+		{"covered", constrained, []string{"*.example.com", "api.example.com", "api.github.com", "10.0.0.1"}, false},
+		{"apex outside subdomain constraint", constrained, []string{"example.com"}, true},
+		{"glob wider than exact constraint", constrained, []string{"*.github.com"}, true},
+		{"uncovered host", constrained, []string{"api.example.net"}, true},
+		{"uncovered IP", constrained, []string{"10.0.0.2"}, true},
+		{"unconstrained CA", unconstrained, []string{"api.example.com"}, true},
+	}
+	for _, tc := range cases {
+		err := CheckCANameConstraints(tc.certPEM, tc.hosts)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
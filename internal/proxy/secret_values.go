@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/awnumar/memguard"
+	"github.com/trodemaster/botlockbox/internal/tmpl"
+)
+
+// minMatchableSecretLen is the shortest secret value searched for in traffic.
+// Shorter values would match innocent bytes far too often.
+const minMatchableSecretLen = 8
+
+// secretValues is a multi-pattern matcher over the exact values of every
+// loaded secret and their common encodings (base64, base64url, strict
+// percent-encoding, hex). All needles live in a single frozen memguard
+// buffer; only their offsets, secret names and encoding names are kept on the
+// Go heap. It is rebuilt from the enclaves on load and on every reload.
+type secretValues struct {
+	buf     *memguard.LockedBuffer
+	needles []needle
+	maxLen  int
+}
+
+// needle locates one encoded secret value inside secretValues.buf.
+type needle struct {
+	secret string
+	form   string
+	off    int
+	len    int
+}
+
+// newSecretValues builds the matcher from the locked secrets. Temporary
+// plaintext copies are scrambled before it returns.
+func newSecretValues(locked map[string]*memguard.Enclave) (*secretValues, error) {
+	type pending struct {
+		secret, form string
+		value        []byte
+	}
+	var forms []pending
+	defer func() {
+		for _, f := range forms {
+			memguard.ScrambleBytes(f.value)
+		}
+	}()
+
+	names := make([]string, 0, len(locked))
+	for name := range locked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		buf, err := locked[name].Open()
+		if err != nil {
+			return nil, fmt.Errorf("opening memguard enclave for %q: %w", name, err)
+		}
+		secret := buf.Bytes()
+		if len(secret) >= minMatchableSecretLen {
+			first := len(forms)
+			add := func(form string, value []byte) {
+				for _, f := range forms[first:] {
+					if bytes.Equal(f.value, value) {
+						memguard.ScrambleBytes(value)
+						return
+					}
+				}
+				forms = append(forms, pending{secret: name, form: form, value: value})
+			}
+			add("raw", append([]byte(nil), secret...))
+			for _, v := range base64Cores(base64.StdEncoding, secret) {
+				add("base64", v)
+			}
+			for _, v := range base64Cores(base64.URLEncoding, secret) {
+				add("base64url", v)
+			}
+			add("urlencoded", tmpl.PercentEncode(secret))
+			lower := make([]byte, hex.EncodedLen(len(secret)))
+			hex.Encode(lower, secret)
+			add("hex", bytes.ToUpper(lower))
+			add("hex", lower)
+		}
+		buf.Destroy()
+	}
+
+	// Longest first, so redaction replaces a whole encoded value before any
+	// shorter needle it contains.
+	sort.SliceStable(forms, func(i, j int) bool { return len(forms[i].value) > len(forms[j].value) })
+
+	v := &secretValues{}
+	total := 0
+	for _, f := range forms {
+		total += len(f.value)
+	}
+	if total == 0 {
+		return v, nil
+	}
+	v.buf = memguard.NewBuffer(total)
+	data := v.buf.Bytes()
+	off := 0
+	for _, f := range forms {
+		copy(data[off:], f.value)
+		v.needles = append(v.needles, needle{secret: f.secret, form: f.form, off: off, len: len(f.value)})
+		if len(f.value) > v.maxLen {
+			v.maxLen = len(f.value)
+		}
+		off += len(f.value)
+	}
+	v.buf.Freeze()
+	return v, nil
+}
+
+// find reports the first needle contained in b whose secret is not in skip.
+func (v *secretValues) find(b []byte, skip map[string]bool) (secret, form string, ok bool) {
+	if v == nil || v.buf == nil {
+		return "", "", false
+	}
+	data := v.buf.Bytes()
+	for _, n := range v.needles {
+		if skip[n.secret] {
+			continue
+		}
+		if bytes.Contains(b, data[n.off:n.off+n.len]) {
+			return n.secret, n.form, true
+		}
+	}
+	return "", "", false
+}
+
+// redact replaces every occurrence of every needle in b and returns the
+// result and the number of replacements.
+func (v *secretValues) redact(b []byte) ([]byte, int) {
+	if v == nil || v.buf == nil {
+		return b, 0
+	}
+	data := v.buf.Bytes()
+	count := 0
+	for _, n := range v.needles {
+		value := data[n.off : n.off+n.len]
+		if c := bytes.Count(b, value); c > 0 {
+			b = bytes.ReplaceAll(b, value, redacted)
+			count += c
+		}
+	}
+	return b, count
+}
+
+// destroy wipes the needle buffer.
+func (v *secretValues) destroy() {
+	if v != nil && v.buf != nil {
+		v.buf.Destroy()
+	}
+}
+
+// base64Cores returns the base64 characters of secret that do not depend on
+// the bytes around it, for each of the three possible byte alignments, so a
+// secret embedded anywhere in a larger base64 payload (e.g. a Basic auth
+// "user:secret" pair) is still found.
+func base64Cores(enc *base64.Encoding, secret []byte) [][]byte {
+	enc = enc.WithPadding(base64.NoPadding)
+	var cores [][]byte
+	for pad := 0; pad < 3; pad++ {
+		src := make([]byte, pad+len(secret))
+		copy(src[pad:], secret)
+		out := make([]byte, enc.EncodedLen(len(src)))
+		enc.Encode(out, src)
+		memguard.ScrambleBytes(src)
+
+		start := (pad*8 + 5) / 6
+		end := len(src) * 8 / 6
+		core := append([]byte(nil), out[start:end]...)
+		memguard.ScrambleBytes(out)
+		if len(core) >= minMatchableSecretLen {
+			cores = append(cores, core)
+		} else {
+			memguard.ScrambleBytes(core)
+		}
+	}
+	return cores
+}
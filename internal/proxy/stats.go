@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Stats is a point-in-time snapshot of proxy counters. It contains no secret
+// names, values or hostnames.
+type Stats struct {
+	LeafCacheHits   uint64 `json:"leaf_cache_hits"`
+	LeafCacheMisses uint64 `json:"leaf_cache_misses"`
+	LeafCacheSize   int    `json:"leaf_cache_size"`
+}
+
+// Stats returns the current proxy counters.
+func (inj *Injector) Stats() Stats {
+	var s Stats
+	s.LeafCacheHits, s.LeafCacheMisses, s.LeafCacheSize = inj.CA.LeafCacheStats()
+	return s
+}
+
+// serveStats answers non-proxy requests: GET /stats returns Stats as JSON,
+// anything else gets goproxy's usual "this is a proxy" error.
+func (inj *Injector) serveStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet || req.URL.Path != "/stats" {
+		http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inj.Stats())
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/elazarl/goproxy"
+	"github.com/trodemaster/botlockbox/internal/config"
+)
+
+// tokenRefreshMargin is how long before its expiry a cached token is replaced.
+const tokenRefreshMargin = 60 * time.Second
+
+// defaultTokenLifetime is assumed for a token whose endpoint reports no expiry.
+const defaultTokenLifetime = 5 * time.Minute
+
+// tokenEndpointTimeout bounds each call to a token endpoint.
+const tokenEndpointTimeout = 15 * time.Second
+
+// tokenCache holds minted access tokens in memguard enclaves until shortly
+// before they expire.
+type tokenCache struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+	gen    uint64 // incremented by purge
+}
+
+// cachedToken is one cache slot. Its mutex serialises minting, so concurrent
+// requests wait for a single call to the token endpoint.
+type cachedToken struct {
+	mu      sync.Mutex
+	enclave *memguard.Enclave
+	refresh time.Time // when a replacement is minted
+	expiry  time.Time // when the token stops being used
+}
+
+// mintFunc obtains a new token and its lifetime. The returned bytes are
+// wiped once they have been sealed into an enclave.
+type mintFunc func() (token []byte, lifetime time.Duration, err error)
+
+// newTokenCache returns an empty cache whose token requests go through rt.
+// Redirects are not followed, so a token endpoint cannot bounce the client
+// credentials to another host.
+func newTokenCache(rt http.RoundTripper) *tokenCache {
+	return &tokenCache{
+		client: &http.Client{
+			Transport: rt,
+			Timeout:   tokenEndpointTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		tokens: make(map[string]*cachedToken),
+	}
+}
+
+// get returns an open buffer holding a valid token for key, calling mint
+// when the cached token is due for refresh. If minting fails while the cached
+// token has not yet expired, get returns the cached token along with the
+// error. A token minted across a purge is returned but not cached. The caller
+// must destroy the buffer.
+func (c *tokenCache) get(key string, mint mintFunc) (*memguard.LockedBuffer, error) {
+	c.mu.Lock()
+	gen := c.gen
+	slot, ok := c.tokens[key]
+	if !ok {
+		slot = &cachedToken{}
+		c.tokens[key] = slot
+	}
+	c.mu.Unlock()
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	now := time.Now()
+	var mintErr error
+	if slot.enclave == nil || !now.Before(slot.refresh) {
+		token, lifetime, err := mint()
+		if err == nil && !c.current(gen) {
+			// The secrets were replaced while minting: the token may serve
+			// this request, but is not kept past the purge.
+			return memguard.NewBufferFromBytes(token), nil
+		}
+		if err == nil {
+			if lifetime <= 0 {
+				lifetime = defaultTokenLifetime
+			}
+			margin := tokenRefreshMargin
+			if lifetime <= 2*margin {
+				margin = lifetime / 2
+			}
+			slot.enclave = memguard.NewEnclave(token)
+			slot.expiry = now.Add(lifetime)
+			slot.refresh = slot.expiry.Add(-margin)
+		} else if slot.enclave == nil || !now.Before(slot.expiry) {
+			slot.enclave = nil
+			return nil, err
+		}
+		mintErr = err
+	}
+	buf, err := slot.enclave.Open()
+	if err != nil {
+		return nil, err
+	}
+	return buf, mintErr
+}
+
+// purge drops every cached token, e.g. after the secrets they were minted
+// from have been replaced.
+func (c *tokenCache) purge() {
+	c.mu.Lock()
+	c.tokens = make(map[string]*cachedToken)
+	c.gen++
+	c.mu.Unlock()
+}
+
+// current reports whether no purge has happened since gen was read.
+func (c *tokenCache) current(gen uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen == gen
+}
+
+// mintedToken describes how a rule obtains and injects a cached token.
+type mintedToken struct {
+	kind      string // audit prefix, e.g. "oauth2"
+	secret    string // sealed secret the token is minted from
+	tokenHost string // host the secret authenticates to when minting
+	key       string // cache key
+	// mint obtains a new token from the secret's enclave. It runs without
+	// inj.mu held, so it must not read Injector state guarded by it.
+	mint func(secret *memguard.Enclave) ([]byte, time.Duration, error)
+	set  func(token []byte) // injects the token into the request
+}
+
+// mintResult is the outcome of obtaining a token for one cache key.
+type mintResult struct {
+	token *memguard.LockedBuffer // nil if no usable token was obtained
+	err   error
+}
+
+// pendingMint is a token a request needs, with the enclave of the secret it
+// is minted from (nil if the secret is not loaded).
+type pendingMint struct {
+	mintedToken
+	enc *memguard.Enclave
+}
+
+// ruleTokens returns the tokens rule injects into req, in the order apply
+// injects them.
+func (inj *Injector) ruleTokens(req *http.Request, rule config.Rule) []mintedToken {
+	var ts []mintedToken
+	if rule.Inject.OAuth2ClientCredentials != nil {
+		ts = append(ts, inj.oauth2Token(req, rule))
+	}
+	if rule.Inject.GitHubApp != nil {
+		ts = append(ts, inj.gitHubAppToken(req, rule))
+	}
+	if rule.Inject.GoogleServiceAccount != nil {
+		ts = append(ts, inj.googleToken(req, rule))
+	}
+	return ts
+}
+
+// pendingMints returns the tokens rules inject into req whose secrets are
+// bound to both req and the token endpoint; injectMintedToken refuses the
+// rest. Callers must hold inj.mu for reading.
+func (inj *Injector) pendingMints(req *http.Request, rules []*config.Rule) []pendingMint {
+	var pending []pendingMint
+	for _, rule := range rules {
+		for _, t := range inj.ruleTokens(req, *rule) {
+			if inj.assertBindingAllowed(t.secret, req.URL.Hostname(), req.Method) != nil ||
+				inj.assertBindingAllowed(t.secret, t.tokenHost, req.Method) != nil {
+				continue
+			}
+			pending = append(pending, pendingMint{mintedToken: t, enc: inj.lockedSecrets[t.secret]})
+		}
+	}
+	return pending
+}
+
+// mintTokens obtains the pending tokens from the cache, minting those due
+// for refresh. Callers must not hold inj.mu, so a slow token endpoint cannot
+// stall a reload and every request behind it, and must destroy the tokens.
+func (inj *Injector) mintTokens(pending []pendingMint) map[string]*mintResult {
+	results := make(map[string]*mintResult, len(pending))
+	for _, p := range pending {
+		if _, ok := results[p.key]; ok {
+			continue
+		}
+		token, err := inj.tokens.get(p.key, func() ([]byte, time.Duration, error) {
+			if p.enc == nil {
+				return nil, 0, fmt.Errorf("secret %q not found in locked secrets", p.secret)
+			}
+			return p.mint(p.enc)
+		})
+		results[p.key] = &mintResult{token: token, err: err}
+	}
+	return results
+}
+
+// injectMintedToken injects the token for t, taken from tokens, into req
+// after checking t.secret against its sealed binding for both req and the
+// token endpoint. Failed refreshes are audited; a cached token that has not
+// yet expired is still used. On failure it returns the response to send
+// instead. Callers must hold inj.mu for reading.
+func (inj *Injector) injectMintedToken(req *http.Request, rule config.Rule, t mintedToken, tokens map[string]*mintResult) *http.Response {
+	for _, host := range []string{req.URL.Hostname(), t.tokenHost} {
+		if err := inj.assertBindingAllowed(t.secret, host, req.Method); err != nil {
+			LogAuditEvent(req, rule.Name, t.secret, false, true, err.Error())
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, 503,
+				"botlockbox: security block -- credential injection refused")
+		}
+	}
+
+	r, ok := tokens[t.key]
+	if !ok {
+		// The binding was granted by a reload after the tokens were minted.
+		r = &mintResult{err: errors.New("no token was minted for this request")}
+	}
+	if r.err != nil {
+		LogAuditEvent(req, rule.Name, t.secret, false, r.token == nil,
+			t.kind+": token refresh failed: "+r.err.Error())
+	}
+	if r.token == nil {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway,
+			"botlockbox: token endpoint unavailable")
+	}
+	t.set(r.token.Bytes())
+
+	logInjection(req, rule.Name, []string{t.secret})
+	return nil
+}
@@ -1,18 +1,50 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 )
 
 // NewVerifyingTransport returns an http.Transport that always verifies
-// upstream TLS certificates, defeating DNS rebinding attacks.
-func NewVerifyingTransport() *http.Transport {
-	return &http.Transport{
+// upstream TLS certificates, defeating DNS rebinding attacks. If clientCert
+// is non-nil, it is asked for the client certificate to present whenever an
+// upstream host requests one during the handshake.
+func NewVerifyingTransport(clientCert func(host string) (*tls.Certificate, error)) *http.Transport {
+	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: false,
 			MinVersion:         tls.VersionTLS12,
 		},
 		ForceAttemptHTTP2: true,
 	}
-}
\ No newline at end of file
+	if clientCert != nil {
+		tr = withClientCertificate(tr, clientCert)
+	}
+	return tr
+}
+
+// withClientCertificate returns a copy of base that asks clientCert for the
+// client certificate to present whenever an upstream host requests one. The
+// copy has its own connection pool, so its connections are never reused by
+// base, and vice versa.
+func withClientCertificate(base *http.Transport, clientCert func(host string) (*tls.Certificate, error)) *http.Transport {
+	tr := base.Clone()
+	// tls.Config.GetClientCertificate is not told which server asked, so
+	// each connection gets a config that closes over its host.
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := tr.TLSClientConfig.Clone()
+		cfg.ServerName = host
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCert(host)
+		}
+		d := &tls.Dialer{Config: cfg}
+		return d.DialContext(ctx, network, addr)
+	}
+	return tr
+}
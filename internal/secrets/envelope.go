@@ -2,6 +2,8 @@ package secrets
 
 import (
 	"fmt"
+	"slices"
+	"sort"
 	"time"
 
 	"github.com/awnumar/memguard"
@@ -12,6 +14,9 @@ import (
 type UnsealResult struct {
 	Envelope      *SealedEnvelope
 	LockedSecrets map[string]*memguard.Enclave
+	// LockedCAKey holds the DER private key of Envelope.CA, if one was sealed.
+	// Envelope.CA.KeyPEM is cleared once the key is locked.
+	LockedCAKey *memguard.Enclave
 }
 
 // SealedEnvelope is the structure that gets age-encrypted to disk.
@@ -21,6 +26,46 @@ type SealedEnvelope struct {
 	SealedAt     time.Time           `json:"sealed_at"`
 	AllowedHosts map[string][]string `json:"allowed_hosts"`
 	Secrets      map[string]string   `json:"secrets"`
+
+	// AllowedMethods binds a secret to the HTTP methods it may be injected
+	// on. Secrets absent from the map may be injected on any method.
+	AllowedMethods map[string][]string `json:"allowed_methods,omitempty"`
+
+	// Egress and EgressAllowlist commit the egress policy at seal time so a
+	// tampered config cannot relax it. Empty Egress means "allow".
+	Egress          string   `json:"egress,omitempty"`
+	EgressAllowlist []string `json:"egress_allowlist,omitempty"`
+
+	// CA, if set, is a persistent MITM CA used instead of an ephemeral one,
+	// so clients only ever need to trust a single, stable certificate.
+	CA *SealedCA `json:"ca,omitempty"`
+}
+
+// SealedCA is a PEM-encoded MITM CA certificate and private key.
+type SealedCA struct {
+	CertPEM string `json:"cert_pem"`
+	KeyPEM  string `json:"key_pem"`
+}
+
+// SealedHosts returns every host pattern committed at seal time -- the union
+// of all secrets' allowed hosts and the egress allowlist -- deduplicated and
+// sorted.
+func (e *SealedEnvelope) SealedHosts() []string {
+	set := make(map[string]struct{})
+	for _, hosts := range e.AllowedHosts {
+		for _, h := range hosts {
+			set[h] = struct{}{}
+		}
+	}
+	for _, h := range e.EgressAllowlist {
+		set[h] = struct{}{}
+	}
+	hosts := make([]string, 0, len(set))
+	for h := range set {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
 }
 
 // Validate checks that every secret+host in configAllowedHosts is present
@@ -44,13 +89,74 @@ func (e *SealedEnvelope) Validate(configAllowedHosts map[string][]string) error
 			if _, allowed := sealedSet[configHost]; !allowed {
 				return fmt.Errorf(
 					"security violation: botlockbox.yaml attempts to use secret %q against host %q, "+
-					"but that host was not committed at seal time.\n"+
-					"  Sealed allowed hosts for %q: %v\n"+
-					"  To add new hosts, re-run `botlockbox seal` with the updated config.",
+						"but that host was not committed at seal time.\n"+
+						"  Sealed allowed hosts for %q: %v\n"+
+						"  To add new hosts, re-run `botlockbox seal` with the updated config.",
 					secretName, configHost, secretName, sealedHosts,
 				)
 			}
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// ValidateMethods checks that the live config never injects a secret on a
+// method that was not committed at seal time. configAllowedMethods comes from
+// Config.AllowedMethodsFromRules, where nil means "any method".
+func (e *SealedEnvelope) ValidateMethods(configAllowedMethods map[string][]string) error {
+	for secretName, configMethods := range configAllowedMethods {
+		sealedMethods, restricted := e.AllowedMethods[secretName]
+		if !restricted {
+			continue
+		}
+		if configMethods == nil {
+			return fmt.Errorf(
+				"security violation: botlockbox.yaml injects secret %q on any HTTP method, "+
+					"but only %v were committed at seal time -- re-run `botlockbox seal` to widen it",
+				secretName, sealedMethods,
+			)
+		}
+		for _, m := range configMethods {
+			if !slices.Contains(sealedMethods, m) {
+				return fmt.Errorf(
+					"security violation: botlockbox.yaml attempts to inject secret %q on method %s, "+
+						"but that method was not committed at seal time.\n"+
+						"  Sealed methods for %q: %v\n"+
+						"  To add new methods, re-run `botlockbox seal` with the updated config.",
+					secretName, m, secretName, sealedMethods,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateEgress checks that the live config's egress policy is no weaker than
+// the one committed at seal time: a sealed "deny" mode cannot be relaxed, and
+// every allowlisted host in the config must have been present at seal time.
+func (e *SealedEnvelope) ValidateEgress(configMode string, configAllowlist []string) error {
+	if e.Egress == "deny" && configMode != "deny" {
+		return fmt.Errorf(
+			"security violation: botlockbox.yaml sets egress %q but egress \"deny\" was committed at seal time -- "+
+				"re-run `botlockbox seal` to change the egress mode",
+			configMode,
+		)
+	}
+
+	sealedSet := make(map[string]struct{}, len(e.EgressAllowlist))
+	for _, h := range e.EgressAllowlist {
+		sealedSet[h] = struct{}{}
+	}
+	for _, configHost := range configAllowlist {
+		if _, allowed := sealedSet[configHost]; !allowed {
+			return fmt.Errorf(
+				"security violation: botlockbox.yaml adds egress host %q, "+
+					"but that host was not committed at seal time.\n"+
+					"  Sealed egress allowlist: %v\n"+
+					"  To add new hosts, re-run `botlockbox seal` with the updated config.",
+				configHost, e.EgressAllowlist,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+// Package tmpl implements the small template language used in rule inject
+// blocks. A template is literal text with {{ ... }} actions; an action is a
+// pipeline of secret references, quoted strings and a fixed set of encoding
+// functions:
+//
+//	Bearer {{secrets.token}}
+//	Basic {{basicAuth "x-access-token" secrets.gh_token}}
+//	{{secrets.api_key | trim | base64}}
+//
+// In a pipeline the value of each command is passed as the last argument of
+// the next. Unlike text/template there are no variables, conditionals or
+// method calls, and every intermediate value that may hold secret bytes is
+// scrambled as soon as it has been consumed.
+package tmpl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/awnumar/memguard"
+)
+
+// Template is a parsed inject template.
+type Template struct {
+	nodes []node
+}
+
+// node is either literal text or, if pipe is non-nil, an action.
+type node struct {
+	text string
+	pipe []command
+}
+
+// command is a single function call, or a bare operand when fn is empty.
+type command struct {
+	fn   string
+	args []operand
+}
+
+// operand is a secret reference or a string literal.
+type operand struct {
+	secret string
+	lit    string
+}
+
+// function is a template function. Arguments are consumed read-only; the
+// result is always a fresh slice the caller owns.
+type function struct {
+	arity int
+	call  func(args [][]byte) []byte
+}
+
+var funcs = map[string]function{
+	"basicAuth": {2, basicAuth},
+	"base64":    {1, func(args [][]byte) []byte { return encodeBase64(args[0]) }},
+	"urlencode": {1, func(args [][]byte) []byte { return PercentEncode(args[0]) }},
+	"sha256hex": {1, sha256Hex},
+	"trim":      {1, trim},
+}
+
+// Parse parses s. It fails on an unterminated action, an unknown function,
+// a call with the wrong number of arguments, or any other malformed action.
+func Parse(s string) (*Template, error) {
+	t := &Template{}
+	for s != "" {
+		i := strings.Index(s, "{{")
+		if i < 0 {
+			t.nodes = append(t.nodes, node{text: s})
+			break
+		}
+		if i > 0 {
+			t.nodes = append(t.nodes, node{text: s[:i]})
+		}
+		s = s[i+2:]
+		end := closingDelim(s)
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed action")
+		}
+		pipe, err := parsePipeline(s[:end])
+		if err != nil {
+			return nil, fmt.Errorf("action {{%s}}: %w", s[:end], err)
+		}
+		t.nodes = append(t.nodes, node{pipe: pipe})
+		s = s[end+2:]
+	}
+	return t, nil
+}
+
+// closingDelim returns the index of the "}}" ending the action at the start
+// of s, skipping any inside string literals, or -1.
+func closingDelim(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '`':
+			for i++; i < len(s) && s[i] != '`'; i++ {
+			}
+		case '}':
+			if strings.HasPrefix(s[i:], "}}") {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parsePipeline(s string) ([]command, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	var pipe []command
+	for len(tokens) > 0 {
+		n := 0
+		for n < len(tokens) && tokens[n] != "|" {
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("missing command")
+		}
+		cmd, err := parseCommand(tokens[:n], len(pipe) > 0)
+		if err != nil {
+			return nil, err
+		}
+		pipe = append(pipe, cmd)
+		if n < len(tokens) {
+			n++ // the "|"
+			if n == len(tokens) {
+				return nil, fmt.Errorf("missing command after |")
+			}
+		}
+		tokens = tokens[n:]
+	}
+	if len(pipe) == 0 {
+		return nil, fmt.Errorf("empty action")
+	}
+	return pipe, nil
+}
+
+// parseCommand parses one pipeline stage. piped reports whether the previous
+// stage's value is appended to its arguments.
+func parseCommand(tokens []string, piped bool) (command, error) {
+	first := tokens[0]
+	if fn, ok := funcs[first]; ok {
+		cmd := command{fn: first}
+		for _, tok := range tokens[1:] {
+			op, err := parseOperand(tok)
+			if err != nil {
+				return command{}, err
+			}
+			cmd.args = append(cmd.args, op)
+		}
+		got := len(cmd.args)
+		if piped {
+			got++
+		}
+		if got != fn.arity {
+			return command{}, fmt.Errorf("%s takes %d argument(s), got %d", first, fn.arity, got)
+		}
+		return cmd, nil
+	}
+	if isIdent(first) && !strings.Contains(first, ".") {
+		return command{}, fmt.Errorf("unknown function %q", first)
+	}
+	if piped {
+		return command{}, fmt.Errorf("cannot pipe into %s", first)
+	}
+	if len(tokens) > 1 {
+		return command{}, fmt.Errorf("unexpected %s after operand", tokens[1])
+	}
+	op, err := parseOperand(first)
+	if err != nil {
+		return command{}, err
+	}
+	return command{args: []operand{op}}, nil
+}
+
+func parseOperand(tok string) (operand, error) {
+	if tok[0] == '"' || tok[0] == '`' {
+		lit, err := strconv.Unquote(tok)
+		if err != nil {
+			return operand{}, fmt.Errorf("bad string %s", tok)
+		}
+		return operand{lit: lit}, nil
+	}
+	name, ok := strings.CutPrefix(tok, "secrets.")
+	if !ok || name == "" || !isIdent(name) || strings.Contains(name, ".") {
+		return operand{}, fmt.Errorf("bad operand %q: want secrets.NAME or a quoted string", tok)
+	}
+	return operand{secret: name}, nil
+}
+
+// tokenize splits an action into identifiers, quoted strings and "|".
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '|':
+			tokens = append(tokens, "|")
+			i++
+		case c == '"' || c == '`':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if c == '"' && s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case isIdentByte(c):
+			j := i
+			for j < len(s) && (isIdentByte(s[j]) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
+
+func isIdent(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isIdentByte(s[i]) && s[i] != '.' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// SecretNames returns the distinct secrets t references, in order.
+func (t *Template) SecretNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, n := range t.nodes {
+		for _, cmd := range n.pipe {
+			for _, op := range cmd.args {
+				if op.secret != "" && !seen[op.secret] {
+					seen[op.secret] = true
+					names = append(names, op.secret)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// Execute renders t, calling lookup once per referenced secret. Execute
+// destroys every buffer lookup returns and scrambles each intermediate value
+// before returning; the caller owns the result and should scramble it once
+// it has been copied to where it is needed.
+func (t *Template) Execute(lookup func(name string) (*memguard.LockedBuffer, error)) ([]byte, error) {
+	secrets := make(map[string]*memguard.LockedBuffer)
+	defer func() {
+		for _, buf := range secrets {
+			buf.Destroy()
+		}
+	}()
+	for _, name := range t.SecretNames() {
+		buf, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		secrets[name] = buf
+	}
+
+	var out []byte
+	for _, n := range t.nodes {
+		if n.pipe == nil {
+			out = append(out, n.text...)
+			continue
+		}
+		v := evalPipeline(n.pipe, secrets)
+		out = grow(out, len(v))
+		out = append(out, v...)
+		memguard.ScrambleBytes(v)
+	}
+	return out, nil
+}
+
+// grow returns out with room for n more bytes. Unlike append it scrambles
+// the old backing array when it has to reallocate, so a partially rendered
+// value is not left behind on the heap.
+func grow(out []byte, n int) []byte {
+	if cap(out)-len(out) >= n {
+		return out
+	}
+	bigger := make([]byte, len(out), 2*cap(out)+n)
+	copy(bigger, out)
+	memguard.ScrambleBytes(out)
+	return bigger
+}
+
+func evalPipeline(pipe []command, secrets map[string]*memguard.LockedBuffer) []byte {
+	var prev []byte
+	for i, cmd := range pipe {
+		args := make([][]byte, 0, len(cmd.args)+1)
+		for _, op := range cmd.args {
+			if op.secret != "" {
+				args = append(args, secrets[op.secret].Bytes())
+			} else {
+				args = append(args, []byte(op.lit))
+			}
+		}
+		if i > 0 {
+			args = append(args, prev)
+		}
+		var v []byte
+		if cmd.fn == "" {
+			v = append([]byte(nil), args[0]...)
+		} else {
+			v = funcs[cmd.fn].call(args)
+		}
+		if prev != nil {
+			memguard.ScrambleBytes(prev)
+		}
+		prev = v
+	}
+	return prev
+}
+
+func basicAuth(args [][]byte) []byte {
+	pair := make([]byte, 0, len(args[0])+1+len(args[1]))
+	pair = append(append(append(pair, args[0]...), ':'), args[1]...)
+	defer memguard.ScrambleBytes(pair)
+	return encodeBase64(pair)
+}
+
+func encodeBase64(b []byte) []byte {
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(out, b)
+	return out
+}
+
+func sha256Hex(args [][]byte) []byte {
+	sum := sha256.Sum256(args[0])
+	defer memguard.ScrambleBytes(sum[:])
+	out := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(out, sum[:])
+	return out
+}
+
+func trim(args [][]byte) []byte {
+	b := args[0]
+	start, end := 0, len(b)
+	for start < end && isSpace(b[start]) {
+		start++
+	}
+	for end > start && isSpace(b[end-1]) {
+		end--
+	}
+	return append([]byte(nil), b[start:end]...)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// PercentEncode escapes every byte outside the RFC 3986 unreserved set as
+// %XX, the strictest form a client can produce.
+func PercentEncode(b []byte) []byte {
+	const hexDigits = "0123456789ABCDEF"
+	out := make([]byte, 0, 3*len(b))
+	for _, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			out = append(out, c)
+			continue
+		}
+		out = append(out, '%', hexDigits[c>>4], hexDigits[c&0xF])
+	}
+	return out
+}